@@ -1,10 +1,13 @@
 package main
 
 import (
+	"compress/gzip"
 	"context"
+	"encoding/hex"
 	"github.com/jessevdk/go-flags"
-	"github.com/reddec/storages/leveldbstorage"
+	"github.com/pkg/errors"
 	"github.com/reddec/wal/mapqueue"
+	"github.com/reddec/wal/mapqueue/leveldb"
 	"github.com/reddec/wal/processor"
 	"github.com/reddec/wal/strategy"
 	"github.com/reddec/wal/stream"
@@ -13,6 +16,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"time"
 )
 
@@ -25,6 +29,91 @@ type HttpStream struct {
 	Success   int           `yaml:"success" short:"s" long:"success" env:"SUCCESS"           description:"HTTP success code" default:"200"`
 	Bind      string        `yaml:"bind"    short:"b" long:"bind"    env:"BIND"              description:"Binding address" default:"localhost:9876"`
 	QueueFile string        `yaml:"file"    short:"q" long:"queue"   env:"QUEUE"             description:"queue file name" default:"queue.dat"`
+	MaxItems  int64         `yaml:"max_items"         long:"max-items" env:"MAX_ITEMS"       description:"maximum number of items in queue (0 - unlimited)"`
+	MaxBytes  int64         `yaml:"max_bytes"         long:"max-bytes" env:"MAX_BYTES"       description:"maximum total size of items in queue (0 - unlimited)"`
+	MaxAge    time.Duration `yaml:"max_age"           long:"max-age"   env:"MAX_AGE"         description:"maximum age of items in queue (0 - unlimited)"`
+	Overflow  string        `yaml:"overflow"          long:"overflow"  env:"OVERFLOW"        description:"behaviour on reached limits" default:"drop" choice:"drop" choice:"reject" choice:"block"`
+	Sync      string        `yaml:"sync"              long:"sync"      env:"SYNC"            description:"flushing of accepted requests to disk" default:"os" choice:"os" choice:"always" choice:"group"`
+	SyncEvery time.Duration `yaml:"sync_interval"     long:"sync-interval" env:"SYNC_INTERVAL" description:"interval of group flushing" default:"10ms"`
+	SyncBytes int64         `yaml:"sync_bytes"        long:"sync-bytes" env:"SYNC_BYTES"     description:"flush group after writing of defined number of bytes (0 - not used, requires sync interval)"`
+	Headers   []string      `yaml:"headers"           long:"header"    env:"HEADERS" env-delim:"," description:"request headers forwarded to target urls"`
+	Dedup     time.Duration `yaml:"dedup"             long:"dedup"     env:"DEDUP"           description:"deduplication window for requests with Idempotency-Key header (0 - disabled)"`
+	DedupBody bool          `yaml:"dedup_body"        long:"dedup-body" env:"DEDUP_BODY"     description:"deduplicate requests without Idempotency-Key header by hash of body"`
+	Compress  string        `yaml:"compress"          long:"compress"  env:"COMPRESS"        description:"compression of stored requests" default:"none" choice:"none" choice:"snappy" choice:"gzip" choice:"zstd"`
+	Keys      []string      `yaml:"keys"              long:"key"       env:"KEYS" env-delim:","  description:"encryption keys of stored requests as id:hex-key, first key is used for new requests"`
+	Cipher    string        `yaml:"cipher"            long:"cipher"    env:"CIPHER"          description:"encryption cipher" default:"aes-gcm" choice:"aes-gcm" choice:"chacha20-poly1305"`
+	Plaintext bool          `yaml:"read_plaintext"    long:"read-plaintext" env:"READ_PLAINTEXT" description:"deliver requests stored before encryption was enabled"`
+}
+
+func (st *HttpStream) overflow() mapqueue.OverflowPolicy {
+	switch st.Overflow {
+	case "reject":
+		return mapqueue.Reject
+	case "block":
+		return mapqueue.Block
+	default:
+		return mapqueue.DropOldest
+	}
+}
+
+func (st *HttpStream) durability() mapqueue.Durability {
+	switch st.Sync {
+	case "always":
+		return mapqueue.SyncAlways()
+	case "group":
+		return mapqueue.GroupCommit(st.SyncEvery, st.SyncBytes)
+	default:
+		return mapqueue.OSManaged()
+	}
+}
+
+func (st *HttpStream) codec() mapqueue.Codec {
+	switch st.Compress {
+	case "snappy":
+		return mapqueue.SnappyCodec()
+	case "gzip":
+		return mapqueue.GzipCodec(gzip.DefaultCompression)
+	case "zstd":
+		return mapqueue.ZstdCodec()
+	default:
+		return nil
+	}
+}
+
+func (st *HttpStream) cipher() mapqueue.Cipher {
+	if st.Cipher == "chacha20-poly1305" {
+		return mapqueue.ChaCha20Poly1305
+	}
+	return mapqueue.AESGCM
+}
+
+func (st *HttpStream) keys() (*mapqueue.StaticKeys, error) {
+	keys := &mapqueue.StaticKeys{Keys: make(map[string][]byte)}
+	for i, pair := range st.Keys {
+		sep := strings.Index(pair, ":")
+		if sep <= 0 {
+			return nil, errors.Errorf("key %v should be in format id:hex-key", i+1)
+		}
+		key, err := hex.DecodeString(pair[sep+1:])
+		if err != nil {
+			return nil, errors.Wrapf(err, "key %v", pair[:sep])
+		}
+		if i == 0 {
+			keys.Current = pair[:sep]
+		}
+		keys.Keys[pair[:sep]] = key
+	}
+	return keys, nil
+}
+
+func forwardHeaders(request *http.Request, names []string) map[string]string {
+	var headers = make(map[string]string)
+	for _, name := range names {
+		if value := request.Header.Get(name); value != "" {
+			headers[http.CanonicalHeaderKey(name)] = value
+		}
+	}
+	return headers
 }
 
 func signalContext() context.Context {
@@ -49,17 +138,35 @@ func main() {
 	}
 	log.SetPrefix("[main] ")
 
-	storage, err := leveldbstorage.New(st.QueueFile)
+	storage, err := leveldb.New(st.QueueFile)
 	if err != nil {
 		panic(err)
 	}
 
 	defer storage.Close()
-	queue, err := mapqueue.NewMapQueue(storage)
+	queueConfig := mapqueue.New(storage).
+		Logger(log.New(os.Stderr, "[queue] ", log.LstdFlags)).
+		Limit(st.MaxItems, st.MaxBytes, st.MaxAge).
+		Overflow(st.overflow()).
+		Durability(st.durability()).
+		Deduplicate(st.Dedup).
+		Codec(st.codec())
+	if len(st.Keys) > 0 {
+		keys, err := st.keys()
+		if err != nil {
+			panic(err)
+		}
+		queueConfig = queueConfig.Encrypt(st.cipher(), keys)
+		if st.Plaintext {
+			queueConfig = queueConfig.ReadPlaintext()
+		}
+	}
+	queue, err := queueConfig.Open()
 
 	if err != nil {
 		panic(queue)
 	}
+	defer queue.Close()
 
 	ctx, cancel := context.WithCancel(signalContext())
 
@@ -79,8 +186,24 @@ func main() {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		err = queue.Put(data)
-		if err != nil {
+		env := &mapqueue.Envelope{Headers: forwardHeaders(request, st.Headers), Data: data}
+		key := request.Header.Get("Idempotency-Key")
+		switch {
+		case st.Dedup > 0 && (key != "" || st.DedupBody):
+			err = queue.PutUniqueEnvelope(request.Context(), key, env)
+		case len(st.Headers) > 0:
+			err = queue.PutEnvelopeContext(request.Context(), env)
+		default:
+			err = queue.PutContext(request.Context(), data)
+		}
+		if mapqueue.IsDuplicate(err) {
+			// already accepted
+			writer.WriteHeader(http.StatusOK)
+			return
+		} else if mapqueue.IsFull(err) {
+			http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+			return
+		} else if err != nil {
 			http.Error(writer, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"fmt"
+	"github.com/jessevdk/go-flags"
+	"github.com/reddec/wal/mapqueue"
+	"github.com/reddec/wal/mapqueue/leveldb"
+	"log"
+	"os"
+)
+
+type Recover struct {
+	QueueFile string `yaml:"file"   short:"q" long:"queue"  env:"QUEUE"  description:"queue file name" default:"queue.dat"`
+	Repair    bool   `yaml:"repair" short:"r" long:"repair" env:"REPAIR" description:"quarantine bad records and fix read pointers"`
+}
+
+func main() {
+	rc := &Recover{}
+	_, err := flags.Parse(rc)
+	if err != nil {
+		os.Exit(1)
+	}
+	log.SetPrefix("[recover] ")
+
+	storage, err := leveldb.New(rc.QueueFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer storage.Close()
+
+	var report *mapqueue.Report
+	if rc.Repair {
+		report, err = mapqueue.Repair(storage)
+	} else {
+		report, err = mapqueue.Check(storage)
+	}
+	if report != nil {
+		printReport(report)
+	}
+	if err != nil {
+		log.Println("failed:", err)
+		storage.Close()
+		os.Exit(2)
+	}
+	if !report.Ok() && !rc.Repair {
+		storage.Close()
+		os.Exit(3)
+	}
+}
+
+func printReport(report *mapqueue.Report) {
+	fmt.Println("items:", report.Items, "first:", report.First, "next:", report.Next)
+	for _, gap := range report.Gaps {
+		fmt.Println("gap:", gap.From, "-", gap.To-1)
+	}
+	for _, key := range report.Foreign {
+		fmt.Printf("foreign key: %q\n", key)
+	}
+	for _, id := range report.Unreadable {
+		fmt.Println("unreadable item:", id)
+	}
+	for _, key := range report.BadCursors {
+		fmt.Printf("bad read pointer: %q\n", key)
+	}
+	for _, key := range report.Orphans {
+		fmt.Printf("orphan meta record: %q\n", key)
+	}
+	if report.Quarantined > 0 {
+		fmt.Println("quarantined:", report.Quarantined)
+	}
+	if report.Ok() {
+		fmt.Println("ok")
+	}
+}
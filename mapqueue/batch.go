@@ -0,0 +1,56 @@
+package mapqueue
+
+import "github.com/reddec/storages"
+
+// Set of storage modifications that should be applied together
+type Batch struct {
+	ops []batchOp
+}
+
+type batchOp struct {
+	key  []byte
+	data []byte
+	del  bool
+}
+
+// Put key and value to batch
+func (b *Batch) Put(key []byte, data []byte) { b.ops = append(b.ops, batchOp{key: key, data: data}) }
+
+// Delete key in batch
+func (b *Batch) Del(key []byte) { b.ops = append(b.ops, batchOp{key: key, del: true}) }
+
+// Number of operations in batch
+func (b *Batch) Len() int { return len(b.ops) }
+
+// Replay all operations in order of definition. Stops on first error
+func (b *Batch) Replay(put func(key []byte, data []byte) error, del func(key []byte) error) error {
+	for _, op := range b.ops {
+		var err error
+		if op.del {
+			err = del(op.key)
+		} else {
+			err = put(op.key, op.data)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Optional extension of storage that can apply batch atomically.
+// Storages without this extension are modified operation by operation
+type BatchStorage interface {
+	// Apply all operations from batch as one atomic operation
+	WriteBatch(batch *Batch) error
+}
+
+func writeBatch(storage storages.Storage, batch *Batch) error {
+	if batch.Len() == 0 {
+		return nil
+	}
+	if batcher, ok := storage.(BatchStorage); ok {
+		return batcher.WriteBatch(batch)
+	}
+	return batch.Replay(storage.Put, storage.Del)
+}
@@ -0,0 +1,199 @@
+package mapqueue
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/golang/snappy"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"io/ioutil"
+	"reflect"
+	"sync"
+)
+
+// Compression of stored records. Codec id is stored with each record, so it should be unique and never changed.
+// Ids from 1 to 15 are reserved for built-in codecs
+type Codec interface {
+	// Unique id of codec
+	Id() byte
+	// Compress record
+	Encode(data []byte) ([]byte, error)
+	// Decompress record
+	Decode(data []byte) ([]byte, error)
+}
+
+const (
+	snappyId byte = 1
+	gzipId   byte = 2
+	zstdId   byte = 3
+)
+
+// marker of compressed record. Marker is followed by codec id and compressed data. Records without marker are
+// stored as is
+var codecMagic = []byte{0, 'C', 'D', 'C'}
+
+var codecs = struct {
+	lock sync.RWMutex
+	byId map[byte]Codec
+}{byId: map[byte]Codec{
+	snappyId: snappyCodec{},
+	gzipId:   gzipCodec{level: gzip.DefaultCompression},
+	zstdId:   &zstdCodec{},
+}}
+
+// Register custom codec for decoding of records. Built-in codecs are always registered
+func RegisterCodec(codec Codec) error {
+	codecs.lock.Lock()
+	defer codecs.lock.Unlock()
+	if codec.Id() < 16 {
+		return errors.Errorf("codec id %v is reserved", codec.Id())
+	}
+	if _, exists := codecs.byId[codec.Id()]; exists {
+		return errors.Errorf("codec id %v already registered", codec.Id())
+	}
+	codecs.byId[codec.Id()] = codec
+	return nil
+}
+
+// Compress records by codec. Records written before (or without) codec are still readable. Custom codecs
+// should be registered (see RegisterCodec), otherwise Open fails
+func (qc *QueueConfig) Codec(codec Codec) *QueueConfig {
+	qc.codec = codec
+	return qc
+}
+
+// check that records compressed by codec could be decoded: the same kind of codec is registered under its id
+func checkCodec(codec Codec) error {
+	if codec == nil {
+		return nil
+	}
+	codecs.lock.RLock()
+	registered, ok := codecs.byId[codec.Id()]
+	codecs.lock.RUnlock()
+	if !ok {
+		return errors.Errorf("codec %v is not registered (see RegisterCodec)", codec.Id())
+	}
+	if reflect.TypeOf(registered) != reflect.TypeOf(codec) {
+		return errors.Errorf("codec id %v is registered for another codec", codec.Id())
+	}
+	return nil
+}
+
+// Snappy compression: fast with moderate ratio
+func SnappyCodec() Codec { return snappyCodec{} }
+
+// Gzip compression with defined level (see compress/gzip)
+func GzipCodec(level int) Codec { return gzipCodec{level: level} }
+
+// Zstandard compression with default level: good ratio with high speed
+func ZstdCodec() Codec { return codecs.byId[zstdId] }
+
+// compress records by codec. Records are kept as is if compression is not effective: they could not start with
+// codec marker, because raw payloads with markers are escaped (see escape)
+func compressRecords(codec Codec, records [][]byte) ([][]byte, error) {
+	var encoded = make([][]byte, len(records))
+	for i, record := range records {
+		data, err := codec.Encode(record)
+		if err != nil {
+			return nil, errors.Wrap(err, "encode record")
+		}
+		if len(data)+len(codecMagic)+1 >= len(record) {
+			encoded[i] = record
+			continue
+		}
+		encoded[i] = append(append(append(make([]byte, 0, len(codecMagic)+1+len(data)), codecMagic...), codec.Id()), data...)
+	}
+	return encoded, nil
+}
+
+// decompress record if it is compressed
+func decompressRecord(id int64, record []byte) ([]byte, error) {
+	if len(record) <= len(codecMagic) || !bytes.HasPrefix(record, codecMagic) {
+		return record, nil
+	}
+	codecId := record[len(codecMagic)]
+	codecs.lock.RLock()
+	codec, ok := codecs.byId[codecId]
+	codecs.lock.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("item %v: unknown codec %v", id, codecId)
+	}
+	data, err := codec.Decode(record[len(codecMagic)+1:])
+	if err != nil {
+		return nil, errors.Wrapf(err, "item %v: decode record", id)
+	}
+	return data, nil
+}
+
+type snappyCodec struct{}
+
+func (snappyCodec) Id() byte { return snappyId }
+
+func (snappyCodec) Encode(data []byte) ([]byte, error) { return snappy.Encode(nil, data), nil }
+
+func (snappyCodec) Decode(data []byte) ([]byte, error) { return snappy.Decode(nil, data) }
+
+type gzipCodec struct {
+	level int
+}
+
+func (gzipCodec) Id() byte { return gzipId }
+
+func (gc gzipCodec) Encode(data []byte) ([]byte, error) {
+	var buffer bytes.Buffer
+	writer, err := gzip.NewWriterLevel(&buffer, gc.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err = writer.Close(); err != nil {
+		return nil, err
+	}
+	return buffer.Bytes(), nil
+}
+
+func (gzipCodec) Decode(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
+
+// zstd encoder and decoder are created once and shared (both are safe for concurrent use)
+type zstdCodec struct {
+	once    sync.Once
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+	err     error
+}
+
+func (zc *zstdCodec) Id() byte { return zstdId }
+
+func (zc *zstdCodec) init() error {
+	zc.once.Do(func() {
+		zc.encoder, zc.err = zstd.NewWriter(nil)
+		if zc.err != nil {
+			return
+		}
+		zc.decoder, zc.err = zstd.NewReader(nil)
+	})
+	return zc.err
+}
+
+func (zc *zstdCodec) Encode(data []byte) ([]byte, error) {
+	if err := zc.init(); err != nil {
+		return nil, err
+	}
+	return zc.encoder.EncodeAll(data, nil), nil
+}
+
+func (zc *zstdCodec) Decode(data []byte) ([]byte, error) {
+	if err := zc.init(); err != nil {
+		return nil, err
+	}
+	return zc.decoder.DecodeAll(data, nil)
+}
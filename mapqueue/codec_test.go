@@ -0,0 +1,95 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"strings"
+	"testing"
+)
+
+func TestQueue_codecs(t *testing.T) {
+	items := []string{
+		string(codecMagic) + "\x09abc",
+		string(codecMagic) + string([]byte{snappyId}) + strings.Repeat("x", 1024),
+		strings.Repeat("compressible ", 100),
+		"short",
+	}
+	for name, codec := range map[string]Codec{
+		"none":   nil,
+		"snappy": SnappyCodec(),
+		"gzip":   GzipCodec(-1),
+		"zstd":   ZstdCodec(),
+	} {
+		t.Run(name, func(t *testing.T) {
+			storage := memstorage.New()
+			queue, err := New(storage).Codec(codec).Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, item := range items {
+				if err := queue.PutString(item); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// records written with one codec are readable with any configuration
+			queue, err = NewMapQueue(storage)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, expected := range items {
+				data, err := queue.HeadString()
+				if err != nil {
+					t.Fatal(err)
+				}
+				if data != expected {
+					t.Fatalf("expected %q, got %q", expected, data)
+				}
+				if err := queue.RemoveN(1); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// gzip under custom id
+type customCodec struct {
+	gzipCodec
+	id byte
+}
+
+func (cc customCodec) Id() byte { return cc.id }
+
+func TestOpen_customCodec(t *testing.T) {
+	if _, err := New(memstorage.New()).Codec(customCodec{gzipCodec{level: -1}, 42}).Open(); err == nil {
+		t.Fatal("queue with not registered codec should not be opened")
+	}
+	if _, err := New(memstorage.New()).Codec(customCodec{gzipCodec{level: -1}, snappyId}).Open(); err == nil {
+		t.Fatal("queue with codec under id of another codec should not be opened")
+	}
+	if err := RegisterCodec(customCodec{gzipCodec{level: -1}, 42}); err != nil {
+		t.Fatal(err)
+	}
+	storage := memstorage.New()
+	queue, err := New(storage).Codec(customCodec{gzipCodec{level: -1}, 42}).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	item := strings.Repeat("compressible ", 100)
+	if err := queue.PutString(item); err != nil {
+		t.Fatal(err)
+	}
+	record, err := storage.Get(itemKey(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(record) >= len(item) {
+		t.Fatal("item is not compressed")
+	}
+	data, err := queue.HeadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != item {
+		t.Fatalf("expected %q, got %q", item, data)
+	}
+}
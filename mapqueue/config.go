@@ -0,0 +1,468 @@
+package mapqueue
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/reddec/storages"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Queue configuration builder
+type QueueConfig struct {
+	storage       storages.Storage
+	persistCursor bool
+	keepConsumed  int64
+	limits        limits
+	durability    Durability
+	logger        Logger
+	envelopes     bool
+	weights       []int
+	dedupWindow   time.Duration
+	codec         Codec
+	encryption    *encryption
+	namespace     string
+	readPlaintext bool
+	trackBytes    bool
+}
+
+// New queue builder over storage. By default read pointer is not persisted and removed items are deleted immediately
+func New(storage storages.Storage) *QueueConfig {
+	return &QueueConfig{storage: storage, logger: log.New(ioutil.Discard, "", log.LstdFlags)}
+}
+
+// Store items put by Put, PutContext and PutBatch in envelope with enqueue time (see Envelope). Items put by
+// PutEnvelope are always stored with envelope. Items are readable regardless of this option
+func (qc *QueueConfig) Envelope() *QueueConfig {
+	qc.envelopes = true
+	return qc
+}
+
+// Set logger for queue warnings (like skipped missing items)
+func (qc *QueueConfig) Logger(logger Logger) *QueueConfig {
+	qc.logger = logger
+	return qc
+}
+
+// Persist read pointer in storage under reserved meta key. Removed items are not deleted immediately but kept
+// according to KeepConsumed policy, so they can be inspected (Get) or replayed (Rewind).
+//
+// Items removed out of order (Commit) are tracked only in memory and will be delivered again after restart.
+// Queue with kept consumed items or named consumers could not be opened without this option.
+func (qc *QueueConfig) PersistCursor() *QueueConfig {
+	qc.persistCursor = true
+	return qc
+}
+
+// Number of already consumed items kept in storage when read pointer is persisted. Negative value means keep
+// all items forever. By default 0 - consumed items are deleted immediately
+func (qc *QueueConfig) KeepConsumed(items int64) *QueueConfig {
+	qc.keepConsumed = items
+	return qc
+}
+
+// Limit number of items, total size of items in bytes and age of items in queue. Zero value means no limit.
+// Oldest items are dropped if they are older then max age. Behaviour on reaching other limits is defined by
+// overflow policy (see Overflow). Consumed items kept in storage (see KeepConsumed) are dropped first.
+//
+// Limits require reading all items while opening queue. Limited age requires additional meta record for each item.
+func (qc *QueueConfig) Limit(maxItems int64, maxBytes int64, maxAge time.Duration) *QueueConfig {
+	qc.limits.maxItems = maxItems
+	qc.limits.maxBytes = maxBytes
+	qc.limits.maxAge = maxAge
+	return qc
+}
+
+// Behaviour of Put when queue limits are reached. By default - drop oldest items
+func (qc *QueueConfig) Overflow(policy OverflowPolicy) *QueueConfig {
+	qc.limits.overflow = policy
+	return qc
+}
+
+// Policy of flushing written items to disk. Policies except OS managed require storage with SyncStorage extension.
+// Put returns error if flush failed, however item is already in queue. By default - OS managed
+func (qc *QueueConfig) Durability(policy Durability) *QueueConfig {
+	qc.durability = policy
+	return qc
+}
+
+// Open queue: restore bounds from ordered storage or persisted layout (or scan storage if layout is missing or
+// inconsistent) and restore pointers
+func (qc *QueueConfig) Open() (*Queue, error) {
+	if err := checkDurability(qc.storage, qc.durability); err != nil {
+		return nil, err
+	}
+	if err := checkCodec(qc.codec); err != nil {
+		return nil, err
+	}
+	var syncFunc = func() error { return nil }
+	if qc.durability.mode != osManaged {
+		syncFunc = qc.storage.(SyncStorage).Sync
+	}
+	lay, err := readLayout(qc.storage)
+	if err != nil {
+		return nil, err
+	}
+	minVal, maxVal, consumers := lay.First, lay.Next, lay.Consumers
+	j := &journal{
+		storage:      qc.storage,
+		writeId:      maxVal,
+		firstId:      minVal,
+		consumers:    make(map[string]*Queue),
+		durable:      qc.persistCursor,
+		keepConsumed: qc.keepConsumed,
+		limits:       qc.limits,
+		syncer:       NewSyncer(qc.durability, syncFunc),
+		logger:       qc.logger,
+		envelopes:    qc.envelopes,
+		codec:        qc.codec,
+		encryption:   qc.encryption,
+		namespace:    qc.encryptionNamespace(),
+		plaintext:    qc.readPlaintext,
+	}
+	q := &Queue{journal: j, committed: make(map[int64]bool)}
+	hasCursor, err := q.restoreCursor()
+	if err != nil {
+		return nil, err
+	}
+	j.consumers[""] = q
+	if !j.durable {
+		if len(consumers) > 0 || q.readId > j.firstId {
+			// cursor was persisted before, but not now: consumed items and consumers would be lost
+			return nil, errors.Errorf("queue has %v kept consumed items and %v consumers: open it with persisted cursor",
+				q.readId-j.firstId, len(consumers))
+		}
+		if hasCursor {
+			// nothing is kept, stale cursor is not needed
+			if err := j.storage.Del(cursorKey); err != nil {
+				return nil, err
+			}
+		}
+		if err := j.open(qc); err != nil {
+			return nil, err
+		}
+		return q, nil
+	}
+	for _, name := range consumers {
+		consumer := &Queue{journal: j, name: name, committed: make(map[int64]bool)}
+		if _, err := consumer.restoreCursor(); err != nil {
+			return nil, errors.Wrapf(err, "consumer %v", name)
+		}
+		j.consumers[name] = consumer
+	}
+	if err := j.open(qc); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// prepare journal after restoring pointers
+func (j *journal) open(qc *QueueConfig) error {
+	if j.limits.enabled() || qc.trackBytes {
+		if err := j.buildIndex(); err != nil {
+			return err
+		}
+		if err := j.expire(); err != nil {
+			return err
+		}
+	}
+	batch := &Batch{}
+	j.putLayout(batch, j.firstId, j.writeId)
+	if err := writeBatch(j.storage, batch); err != nil {
+		return err
+	}
+	j.layoutFirst, j.layoutNext = j.firstId, j.writeId
+	if err := j.loadDedup(qc.dedupWindow); err != nil {
+		return err
+	}
+	return j.loadSchedule()
+}
+
+// add persisted layout to batch if defined bounds of items moved from persisted ones by layoutInterval items or more.
+// Returns true if layout is added. Should be called under write lock
+func (j *journal) driftLayout(batch *Batch, firstId, writeId int64) bool {
+	if firstId-j.layoutFirst < layoutInterval && writeId-j.layoutNext < layoutInterval {
+		return false
+	}
+	j.putLayout(batch, firstId, writeId)
+	return true
+}
+
+// Stop moving of delayed items and persist layout, so next opening will not look for bounds of items. Queue and
+// its consumers should not be used after close. Storage is not closed
+func (q *Queue) Close() error {
+	q.stopSchedule()
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	batch := &Batch{}
+	q.putLayout(batch, q.firstId, q.writeId)
+	if err := writeBatch(q.storage, batch); err != nil {
+		return err
+	}
+	q.layoutFirst, q.layoutNext = q.firstId, q.writeId
+	return nil
+}
+
+// add persisted layout with defined bounds of items to batch. Should be called under write lock
+func (j *journal) putLayout(batch *Batch, firstId, writeId int64) {
+	lay := &layout{First: firstId, Next: writeId}
+	for name := range j.consumers {
+		if name != "" {
+			lay.Consumers = append(lay.Consumers, name)
+		}
+	}
+	sort.Strings(lay.Consumers)
+	data, _ := json.Marshal(lay)
+	batch.Put(layoutKey, data)
+}
+
+// restore read pointer from persisted value if exists
+func (q *Queue) restoreCursor() (bool, error) {
+	q.readId = q.firstId
+	cursor, err := q.storage.Get(q.cursorKey())
+	if os.IsNotExist(err) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	readId, err := decodeInt(cursor)
+	if err != nil {
+		return false, errors.Wrap(err, "decode cursor")
+	}
+	if readId > q.readId {
+		q.readId = readId
+	}
+	if q.readId > q.writeId {
+		q.readId = q.writeId
+	}
+	return true, nil
+}
+
+// bounds of persisted layout could be behind actual bounds by less than this number of items
+const layoutInterval = 256
+
+// bounds of items and names of consumers in storage. Persisted under reserved meta key periodically (see
+// layoutInterval), on changes of consumers and on close
+type layout struct {
+	First     int64    `json:"first"`
+	Next      int64    `json:"next"`
+	Consumers []string `json:"consumers,omitempty"`
+}
+
+// find items and consumers in storage. First and last items are found by ordered storage, otherwise persisted
+// layout is used if it is consistent with items, otherwise by scanning all keys. Keys in legacy format are
+// migrated to binary format
+func readLayout(storage storages.Storage) (*layout, error) {
+	format, err := storage.Get(formatKey)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil && string(format) == binaryFormat {
+		if ordered, ok := storage.(OrderedStorage); ok {
+			return seekLayout(ordered, storage)
+		}
+		if lay, err := loadLayout(storage); err != nil {
+			return nil, err
+		} else if lay != nil {
+			return lay, nil
+		}
+		return scanLayout(storage, false)
+	}
+	return scanLayout(storage, true)
+}
+
+// read persisted layout and move its bounds forward to actual ones by probing items (layout is not persisted on
+// every change, see layoutInterval). Returns nil if layout is missing or inconsistent
+func loadLayout(storage storages.Storage) (*layout, error) {
+	data, err := storage.Get(layoutKey)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var lay layout
+	if err := json.Unmarshal(data, &lay); err != nil || lay.First > lay.Next {
+		return nil, nil
+	}
+	exists := func(id int64) (bool, error) {
+		_, err := storage.Get(itemKey(id))
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	// bounds only move forward
+	if found, err := exists(lay.First - 1); err != nil || found {
+		return nil, err
+	}
+	next := lay.Next
+	for id := lay.Next; id < lay.Next+layoutInterval; id++ {
+		found, err := exists(id)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			next = id + 1
+		}
+	}
+	if found, err := exists(lay.Next + layoutInterval); err != nil || found {
+		return nil, err
+	}
+	lay.Next = next
+	for first := lay.First; lay.First < lay.Next; lay.First++ {
+		if lay.First >= first+layoutInterval {
+			// too many missing items at head
+			return nil, nil
+		}
+		found, err := exists(lay.First)
+		if err != nil {
+			return nil, err
+		}
+		if found {
+			break
+		}
+	}
+	for _, name := range lay.Consumers {
+		if _, err := storage.Get(consumerKey(name)); err != nil {
+			return nil, nil
+		}
+	}
+	return &lay, nil
+}
+
+// find bounds by first and last keys
+func seekLayout(ordered OrderedStorage, storage storages.Storage) (*layout, error) {
+	lay := &layout{}
+	first, err := edgeKey(ordered, []byte(itemPrefix), false)
+	if err != nil {
+		return nil, err
+	}
+	last, err := edgeKey(ordered, []byte(itemPrefix), true)
+	if err != nil {
+		return nil, err
+	}
+	if first != nil && last != nil {
+		var ok bool
+		if lay.First, ok = parseItemKey(first); !ok {
+			return nil, errors.Errorf("unknown key %q (storage could be fixed by Repair)", first)
+		}
+		if lay.Next, ok = parseItemKey(last); !ok {
+			return nil, errors.Errorf("unknown key %q (storage could be fixed by Repair)", last)
+		}
+		lay.Next++ // point to next cell for writing
+	}
+	err = prefixKeys(storage, []byte(consumerPrefix), func(key []byte) error {
+		lay.Consumers = append(lay.Consumers, string(key[len(consumerPrefix):]))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return lay, nil
+}
+
+// find bounds by scanning all keys. If legacy is allowed, decimal keys are migrated
+func scanLayout(storage storages.Storage, legacy bool) (*layout, error) {
+	var minVal int64 = math.MaxInt64
+	var maxVal int64 = math.MinInt64
+	var empty = true
+	var consumers []string
+	var legacyIds []int64
+	var legacyTimes [][]byte
+	err := storage.Keys(func(key []byte) error {
+		if name := string(key); strings.HasPrefix(name, consumerPrefix) {
+			consumers = append(consumers, name[len(consumerPrefix):])
+			return nil
+		}
+		if legacy && strings.HasPrefix(string(key), timePrefix) {
+			// keys of interrupted migration are binary and never decimal (see parseLegacyTimeKey)
+			if _, ok := parseLegacyTimeKey(key); ok {
+				legacyTimes = append(legacyTimes, append([]byte(nil), key...))
+			}
+			return nil
+		}
+		if isMetaKey(key) {
+			return nil
+		}
+		id, ok := parseItemKey(key)
+		if !ok && legacy {
+			id, ok = parseLegacyItemKey(key)
+			if ok {
+				legacyIds = append(legacyIds, id)
+			}
+		}
+		if !ok {
+			return errors.Errorf("unknown key %q (storage could be fixed by Repair)", key)
+		}
+		if id < minVal {
+			minVal = id
+		}
+		if id > maxVal {
+			maxVal = id
+		}
+		empty = false
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if legacy {
+		if err := migrateKeys(storage, legacyIds, legacyTimes); err != nil {
+			return nil, errors.Wrap(err, "migrate keys")
+		}
+	}
+	if empty {
+		return &layout{Consumers: consumers}, nil
+	}
+	return &layout{First: minVal, Next: maxVal + 1, Consumers: consumers}, nil
+}
+
+// move items and their meta records from decimal keys to binary keys by chunks and mark storage as migrated.
+// Interrupted migration continues on next open
+func migrateKeys(storage storages.Storage, ids []int64, times [][]byte) error {
+	const chunk = 1024
+	batch := &Batch{}
+	flush := func(force bool) error {
+		if batch.Len() < chunk && !force {
+			return nil
+		}
+		err := writeBatch(storage, batch)
+		batch = &Batch{}
+		return err
+	}
+	for _, id := range ids {
+		legacyKey := []byte(strconv.FormatInt(id, 10))
+		data, err := storage.Get(legacyKey)
+		if err != nil {
+			return errors.Wrapf(err, "read item %v", id)
+		}
+		batch.Put(itemKey(id), data)
+		batch.Del(legacyKey)
+		if err := flush(false); err != nil {
+			return err
+		}
+	}
+	for _, key := range times {
+		batch.Del(key)
+		id, ok := parseLegacyTimeKey(key)
+		if !ok {
+			continue
+		}
+		data, err := storage.Get(key)
+		if err != nil {
+			continue
+		}
+		batch.Put(timeKey(id), data)
+		if err := flush(false); err != nil {
+			return err
+		}
+	}
+	batch.Put(formatKey, []byte(binaryFormat))
+	return flush(true)
+}
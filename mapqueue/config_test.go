@@ -0,0 +1,129 @@
+package mapqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"github.com/reddec/storages"
+	"github.com/reddec/storages/memstorage"
+	"testing"
+)
+
+func TestOpen_withoutPersistedCursor(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().KeepConsumed(-1).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RemoveN(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewMapQueue(storage); err == nil {
+		t.Fatal("expected error on opening queue with kept items without persisted cursor")
+	}
+
+	queue, err = New(storage).PersistCursor().KeepConsumed(-1).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queue.FirstId() != 0 || queue.Size() != 1 {
+		t.Fatal("data lost: first id", queue.FirstId(), "size", queue.Size())
+	}
+}
+
+func TestOpen_staleCursor(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("b"); err != nil {
+		t.Fatal(err)
+	}
+	// nothing is kept, so queue could be opened without persisted cursor
+	queue, err = NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if head, err := queue.HeadString(); err != nil || head != "b" {
+		t.Fatal("unexpected head", head, err)
+	}
+	if _, err := storage.Get(cursorKey); err == nil {
+		t.Fatal("stale cursor is not removed")
+	}
+}
+
+// storage that counts writes of layout
+type layoutCounter struct {
+	storages.Storage
+	writes int
+}
+
+func (lc *layoutCounter) Put(key []byte, data []byte) error {
+	if bytes.Equal(key, layoutKey) {
+		lc.writes++
+	}
+	return lc.Storage.Put(key, data)
+}
+
+func TestOpen_staleLayout(t *testing.T) {
+	storage := &layoutCounter{Storage: memstorage.New()}
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	storage.writes = 0
+	for i := 0; i < 3*layoutInterval+10; i++ {
+		if err := queue.PutString(string(rune('a' + i%26))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < layoutInterval+5; i++ {
+		if _, err := queue.Pop(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if storage.writes != 4 {
+		t.Fatal("expected layout persisted once per interval, got writes:", storage.writes)
+	}
+	// reopen without close: bounds are behind actual ones
+	queue, err = NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if size := queue.Size(); size != 2*layoutInterval+5 {
+		t.Fatal("unexpected size after reopening:", size)
+	}
+	data, err := queue.Pop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := string(rune('a' + (layoutInterval+5)%26)); string(data) != expected {
+		t.Fatalf("expected %v, got %v", expected, string(data))
+	}
+
+	if err := queue.Close(); err != nil {
+		t.Fatal(err)
+	}
+	raw, err := storage.Get(layoutKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var lay layout
+	if err := json.Unmarshal(raw, &lay); err != nil {
+		t.Fatal(err)
+	}
+	if lay.First != layoutInterval+6 || lay.Next != 3*layoutInterval+10 {
+		t.Fatalf("layout is not actual after close: %+v", lay)
+	}
+}
@@ -0,0 +1,106 @@
+package mapqueue
+
+import (
+	"github.com/pkg/errors"
+	"sort"
+)
+
+// Get or create named consumer of queue. Each consumer has own persisted read pointer and sees all items
+// regardless of other consumers. Items are deleted from storage only after all consumers (including default one)
+// passed them. New consumer starts from the oldest item kept in storage. Requires persisted cursor
+// (see QueueConfig.PersistCursor)
+func (q *Queue) Consumer(name string) (*Queue, error) {
+	if name == "" {
+		return nil, errors.New("consumer name should not be empty")
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if !q.durable {
+		return nil, errors.New("consumers are supported only for persisted cursor")
+	}
+	if consumer, ok := q.consumers[name]; ok {
+		return consumer, nil
+	}
+	consumer := &Queue{journal: q.journal, name: name, readId: q.firstId, committed: make(map[int64]bool)}
+	q.consumers[name] = consumer
+	batch := &Batch{}
+	batch.Put(consumer.cursorKey(), encodeInt(consumer.readId))
+	q.putLayout(batch, q.firstId, q.writeId)
+	err := writeBatch(q.storage, batch)
+	if err != nil {
+		delete(q.consumers, name)
+		return nil, err
+	}
+	return consumer, nil
+}
+
+// Names of all named consumers in alphabet order
+func (q *Queue) Consumers() []string {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	var names []string
+	for name := range q.consumers {
+		if name != "" {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Remove named consumer and its read pointer. Items that are not needed anymore by remaining consumers are
+// deleted according to retention. Queue of removed consumer should not be used anymore
+func (q *Queue) RemoveConsumer(name string) error {
+	if name == "" {
+		return errors.New("default consumer could not be removed")
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	consumer, ok := q.consumers[name]
+	if !ok {
+		return nil
+	}
+	delete(q.consumers, name)
+	batch := &Batch{}
+	batch.Del(consumerKey(name))
+	firstId := q.firstId
+	minReadId := q.minReadId(nil, 0)
+	for ; q.keepConsumed >= 0 && firstId < minReadId-q.keepConsumed; firstId++ {
+		q.delItem(batch, firstId)
+	}
+	q.putLayout(batch, firstId, q.writeId)
+	err := writeBatch(q.storage, batch)
+	if err != nil {
+		q.consumers[name] = consumer
+		return err
+	}
+	q.firstId = firstId
+	q.forget(nil)
+	return nil
+}
+
+// Name of consumer. Empty for default consumer
+func (q *Queue) Name() string { return q.name }
+
+func (q *Queue) cursorKey() []byte {
+	if q.name == "" {
+		return cursorKey
+	}
+	return consumerKey(q.name)
+}
+
+// minimal read pointer over all consumers. Read pointer of consumer c could be overridden.
+// Should be called under lock
+func (j *journal) minReadId(c *Queue, readId int64) int64 {
+	var minReadId = j.writeId
+	for name, consumer := range j.consumers {
+		value := consumer.readId
+		if c != nil && name == c.name {
+			value = readId
+		}
+		if value < minReadId {
+			minReadId = value
+		}
+	}
+	return minReadId
+}
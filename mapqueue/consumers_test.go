@@ -0,0 +1,171 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"testing"
+)
+
+func TestOpen_consumersWithoutPersistedCursor(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := queue.Consumer("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RemoveN(2); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewMapQueue(storage); err == nil {
+		t.Fatal("expected error on opening queue with consumers without persisted cursor")
+	}
+
+	queue, err = New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err = queue.Consumer("archive")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archive.Size() != 3 || queue.Size() != 1 {
+		t.Fatal("data lost: consumer has", archive.Size(), "items, default consumer has", queue.Size())
+	}
+}
+
+func expectHead(t *testing.T, queue *Queue, expected string) {
+	head, err := queue.HeadString()
+	if err != nil {
+		t.Fatal(queue.Name(), err)
+	}
+	if head != expected {
+		t.Fatalf("consumer %q: expected head %v, got %v", queue.Name(), expected, head)
+	}
+}
+
+func TestQueue_consumersAdvanceIndependently(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := queue.Consumer("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := queue.Consumer("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := first.RemoveN(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := second.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	expectHead(t, queue, "a")
+	expectHead(t, first, "c")
+	expectHead(t, second, "b")
+
+	// cursors survive reopen
+	queue, err = New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := queue.Consumers(); len(names) != 2 || names[0] != "first" || names[1] != "second" {
+		t.Fatal("unexpected consumers after reopen:", names)
+	}
+	first, err = queue.Consumer("first")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err = queue.Consumer("second")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectHead(t, queue, "a")
+	expectHead(t, first, "c")
+	expectHead(t, second, "b")
+}
+
+func TestQueue_consumersCollectPassedItems(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	slow, err := queue.Consumer("slow")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RemoveN(3); err != nil {
+		t.Fatal(err)
+	}
+	// items are kept for slow consumer
+	if _, err := queue.Get(0); err != nil {
+		t.Fatal("item deleted before all consumers passed it:", err)
+	}
+	if err := slow.RemoveN(2); err != nil {
+		t.Fatal(err)
+	}
+	if queue.FirstId() != 2 {
+		t.Fatal("items passed by all consumers are not deleted, first id", queue.FirstId())
+	}
+	if _, err := queue.Get(1); err != ErrNotFound {
+		t.Fatal("expected deleted item, got", err)
+	}
+	expectHead(t, slow, "c")
+}
+
+func TestQueue_RemoveConsumer(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Consumer("slow"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RemoveN(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RemoveConsumer(""); err == nil {
+		t.Fatal("default consumer should not be removed")
+	}
+	if err := queue.RemoveConsumer("slow"); err != nil {
+		t.Fatal(err)
+	}
+	// items kept only for removed consumer are deleted
+	if queue.FirstId() != queue.WriteId() {
+		t.Fatal("items of removed consumer are kept, first id", queue.FirstId())
+	}
+	if names := queue.Consumers(); len(names) != 0 {
+		t.Fatal("removed consumer is listed:", names)
+	}
+
+	queue, err = New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := queue.Consumers(); len(names) != 0 {
+		t.Fatal("removed consumer is restored after reopen:", names)
+	}
+	if !queue.Empty() {
+		t.Fatal("queue should be empty")
+	}
+}
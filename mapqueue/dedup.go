@@ -0,0 +1,199 @@
+package mapqueue
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/pkg/errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// prefix of records of recently put unique items. Value is time of put (unix nanoseconds). If encryption is enabled,
+// key is replaced by its HMAC (see dedupName)
+const dedupPrefix = metaPrefix + "dedup/"
+
+func dedupKey(key string) []byte { return []byte(dedupPrefix + key) }
+
+// Error returned by PutUnique if item with same key was already put within deduplication window
+type DuplicateError struct {
+	Key  string    // deduplication key
+	Time time.Time // time when original item was put
+}
+
+func (de *DuplicateError) Error() string {
+	return fmt.Sprintf("duplicate of item %q put at %v", de.Key, de.Time.Format(time.RFC3339Nano))
+}
+
+// Check that error caused by already put item with same deduplication key
+func IsDuplicate(err error) bool {
+	_, ok := err.(*DuplicateError)
+	return ok
+}
+
+// Remember keys of unique items for defined time window. Each unique put records key with time in storage, so
+// duplicates are detected after restart. Deduplication requires reading all records while opening queue.
+//
+// If encryption is enabled, only HMAC of key under current encryption key is stored, so duplicates of items put
+// before rotation of current key are not detected
+func (qc *QueueConfig) Deduplicate(window time.Duration) *QueueConfig {
+	qc.dedupWindow = window
+	return qc
+}
+
+type dedupEntry struct {
+	key  string
+	time int64
+}
+
+// keys of unique items put within window
+type dedupIndex struct {
+	lock    sync.Mutex
+	window  time.Duration
+	entries []dedupEntry     // ordered by time, may contain outdated entries of re-used keys
+	times   map[string]int64 // actual time of put for each key
+}
+
+// Put item only if no item with same key was put within deduplication window (see QueueConfig.Deduplicate),
+// otherwise DuplicateError is returned. If key is empty, hash of content is used
+func (q *Queue) PutUnique(key string, data []byte) error {
+	return q.PutUniqueContext(context.Background(), key, data)
+}
+
+// Put unique item. See PutUnique and PutContext
+func (q *Queue) PutUniqueContext(ctx context.Context, key string, data []byte) error {
+	records, err := q.wrap([][]byte{data})
+	if err != nil {
+		return err
+	}
+	return q.putUnique(ctx, uniqueKey(key, data), records[0])
+}
+
+// Put unique item with metadata. If key is empty, hash of data is used. See PutUnique and PutEnvelopeContext
+func (q *Queue) PutUniqueEnvelope(ctx context.Context, key string, env *Envelope) error {
+	record, err := encodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	return q.putUnique(ctx, uniqueKey(key, env.Data), record)
+}
+
+func uniqueKey(key string, data []byte) string {
+	if key != "" {
+		return key
+	}
+	hash := sha256.Sum256(data)
+	return "sha256:" + hex.EncodeToString(hash[:])
+}
+
+func (j *journal) putUnique(ctx context.Context, key string, record []byte) error {
+	d := j.dedup
+	if d == nil {
+		return errors.New("deduplication is not enabled")
+	}
+	records, err := j.encode([][]byte{record})
+	if err != nil {
+		return err
+	}
+	name, err := j.dedupName(key)
+	if err != nil {
+		return err
+	}
+	d.lock.Lock()
+	now := time.Now().UnixNano()
+	if putTime, ok := d.times[name]; ok && !d.outdated(putTime, now) {
+		d.lock.Unlock()
+		return &DuplicateError{Key: key, Time: time.Unix(0, putTime)}
+	}
+	batch := &Batch{}
+	d.forget(d.expired(batch, now))
+	// key is reserved before writing, so lock is not held while put is blocked by full queue (see Block)
+	d.entries = append(d.entries, dedupEntry{key: name, time: now})
+	d.times[name] = now
+	d.lock.Unlock()
+	batch.Put(dedupKey(name), encodeInt(now))
+	if err := j.putWith(ctx, records, batch); err != nil {
+		d.lock.Lock()
+		if d.times[name] == now {
+			delete(d.times, name)
+		}
+		d.lock.Unlock()
+		return err
+	}
+	return nil
+}
+
+// name of deduplication record for key. If encryption is enabled, name is HMAC of key (caller key or hash of
+// content) under secret derived from current encryption key, so neither keys nor equality of payloads are revealed
+func (j *journal) dedupName(key string) (string, error) {
+	if j.encryption == nil {
+		return key, nil
+	}
+	_, secret, err := j.encryption.keys.CurrentKey()
+	if err != nil {
+		return "", errors.Wrap(err, "get current key")
+	}
+	derive := hmac.New(sha256.New, secret)
+	derive.Write([]byte("deduplication"))
+	mac := hmac.New(sha256.New, derive.Sum(nil))
+	mac.Write(j.namespace)
+	mac.Write([]byte(key))
+	return "hmac:" + hex.EncodeToString(mac.Sum(nil)), nil
+}
+
+func (d *dedupIndex) outdated(putTime, now int64) bool { return now-putTime >= int64(d.window) }
+
+// number of outdated entries from beginning. Records of expired keys are added to batch for deletion
+func (d *dedupIndex) expired(batch *Batch, now int64) int {
+	var n int
+	for n < len(d.entries) && d.outdated(d.entries[n].time, now) {
+		entry := d.entries[n]
+		if d.times[entry.key] == entry.time {
+			batch.Del(dedupKey(entry.key))
+		}
+		n++
+	}
+	return n
+}
+
+// drop first n entries. Their records are deleted by the batch (see expired)
+func (d *dedupIndex) forget(n int) {
+	for _, entry := range d.entries[:n] {
+		if d.times[entry.key] == entry.time {
+			delete(d.times, entry.key)
+		}
+	}
+	d.entries = d.entries[n:]
+}
+
+// load records of unique items. Should be called once while opening queue
+func (j *journal) loadDedup(window time.Duration) error {
+	if window <= 0 {
+		return nil
+	}
+	d := &dedupIndex{window: window, times: make(map[string]int64)}
+	err := prefixKeys(j.storage, []byte(dedupPrefix), func(key []byte) error {
+		value, err := j.storage.Get(key)
+		if err != nil {
+			return err
+		}
+		putTime, err := decodeInt(value)
+		if err != nil {
+			j.logger.Println("skip invalid deduplication record", string(key), ":", err)
+			return nil
+		}
+		name := string(key[len(dedupPrefix):])
+		d.entries = append(d.entries, dedupEntry{key: name, time: putTime})
+		d.times[name] = putTime
+		return nil
+	})
+	if err != nil {
+		return errors.Wrap(err, "load deduplication records")
+	}
+	sort.Slice(d.entries, func(a, b int) bool { return d.entries[a].time < d.entries[b].time })
+	j.dedup = d
+	return nil
+}
@@ -0,0 +1,97 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"testing"
+	"time"
+)
+
+func TestQueue_PutUniqueAfterRestart(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).Deduplicate(time.Hour).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("order-1", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	// duplicates are detected even after item is consumed
+	if err := queue.RemoveN(2); err != nil {
+		t.Fatal(err)
+	}
+
+	queue, err = New(storage).Deduplicate(time.Hour).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("order-1", []byte("second")); !IsDuplicate(err) {
+		t.Fatal("expected duplicate by key after restart, got", err)
+	}
+	if err := queue.PutUnique("", []byte("content")); !IsDuplicate(err) {
+		t.Fatal("expected duplicate by content after restart, got", err)
+	}
+	if err := queue.PutUnique("order-2", []byte("third")); err != nil {
+		t.Fatal(err)
+	}
+	if size := queue.Size(); size != 1 {
+		t.Fatal("expected only unique item in queue, got size", size)
+	}
+
+	// outside of window keys are forgotten and their records are removed
+	queue, err = New(storage).Deduplicate(time.Nanosecond).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("order-1", []byte("again")); err != nil {
+		t.Fatal("key should be forgotten outside of window:", err)
+	}
+	if _, err := storage.Get(dedupKey("order-2")); err == nil {
+		t.Fatal("record of expired key should be removed")
+	}
+}
+
+func TestQueue_PutUniqueBlocked(t *testing.T) {
+	queue, err := New(memstorage.New()).Deduplicate(time.Hour).Limit(1, 0, 0).Overflow(Block).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("a", []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := make(chan error, 1)
+	go func() { blocked <- queue.PutUniqueContext(ctx, "b", []byte("b")) }()
+	time.Sleep(50 * time.Millisecond)
+
+	// other keys are not blocked by deduplication while put is waiting for free space
+	checked := make(chan error, 1)
+	go func() { checked <- queue.PutUnique("a", []byte("a")) }()
+	select {
+	case err := <-checked:
+		if !IsDuplicate(err) {
+			t.Fatal("expected duplicate, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("deduplication is blocked by waiting put")
+	}
+	// key of waiting put is reserved
+	if err := queue.PutUniqueContext(ctx, "b", []byte("b")); !IsDuplicate(err) {
+		t.Fatal("expected duplicate of waiting put, got", err)
+	}
+
+	cancel()
+	if err := <-blocked; err != context.Canceled {
+		t.Fatal("expected cancellation, got", err)
+	}
+	// key of cancelled put is released
+	if err := queue.RemoveN(1); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("b", []byte("b")); err != nil {
+		t.Fatal("key of cancelled put should be released:", err)
+	}
+}
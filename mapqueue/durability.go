@@ -0,0 +1,117 @@
+package mapqueue
+
+import (
+	"github.com/pkg/errors"
+	"github.com/reddec/storages"
+	"sync"
+	"time"
+)
+
+type durabilityMode int
+
+const (
+	osManaged durabilityMode = iota
+	syncAlways
+	groupCommit
+)
+
+// Policy of flushing written data to disk. By default flushing is managed by OS
+type Durability struct {
+	mode     durabilityMode
+	interval time.Duration
+	bytes    int64
+}
+
+// Flushing managed by OS (and storage). Fastest, but last writes could be lost after power failure
+func OSManaged() Durability { return Durability{mode: osManaged} }
+
+// Flush after each write. Slowest, but write is completed only after data reached disk
+func SyncAlways() Durability { return Durability{mode: syncAlways} }
+
+// Flush once per interval or after writing of defined number of bytes (whichever comes first), zero bytes means
+// not used. Write is completed only after flush, so concurrent writers share one flush. Bytes threshold requires
+// interval (otherwise single writer could wait forever): without interval writes are flushed immediately and only
+// writers that are already waiting share the flush
+func GroupCommit(interval time.Duration, bytes int64) Durability {
+	if interval <= 0 {
+		bytes = 0
+	}
+	return Durability{mode: groupCommit, interval: interval, bytes: bytes}
+}
+
+// Optional extension of storage that can flush written data to disk. Required by durability policies except
+// OS managed
+type SyncStorage interface {
+	// Flush all written data to disk
+	Sync() error
+}
+
+// check that storage supports durability policy
+func checkDurability(storage storages.Storage, policy Durability) error {
+	if policy.mode == osManaged {
+		return nil
+	}
+	if _, ok := storage.(SyncStorage); !ok {
+		return errors.New("durability policy requires storage with sync support")
+	}
+	return nil
+}
+
+// Waits for flushing of written data according to durability policy. Thread safe
+type Syncer struct {
+	policy  Durability
+	sync    func() error
+	lock    sync.Mutex
+	pending int64
+	waiters []chan error
+	timer   *time.Timer
+}
+
+// New syncer that uses sync function to flush data
+func NewSyncer(policy Durability, sync func() error) *Syncer {
+	return &Syncer{policy: policy, sync: sync}
+}
+
+// Wait till data of defined size, that already written, will be flushed according to policy
+func (s *Syncer) Wait(written int64) error {
+	switch s.policy.mode {
+	case syncAlways:
+		return s.sync()
+	case groupCommit:
+	default:
+		return nil
+	}
+	done := make(chan error, 1)
+	s.lock.Lock()
+	s.waiters = append(s.waiters, done)
+	s.pending += written
+	if s.policy.bytes > 0 && s.pending >= s.policy.bytes || s.policy.interval <= 0 {
+		s.lock.Unlock()
+		s.flush()
+	} else {
+		if s.timer == nil {
+			s.timer = time.AfterFunc(s.policy.interval, s.flush)
+		}
+		s.lock.Unlock()
+	}
+	return <-done
+}
+
+func (s *Syncer) flush() {
+	s.lock.Lock()
+	waiters := s.waiters
+	s.waiters = nil
+	s.pending = 0
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+	s.lock.Unlock()
+	if len(waiters) == 0 {
+		return
+	}
+	err := s.sync()
+	for _, done := range waiters {
+		done <- err
+	}
+}
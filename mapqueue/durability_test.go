@@ -0,0 +1,52 @@
+package mapqueue
+
+import (
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestSyncer_bytesThreshold(t *testing.T) {
+	var syncs int32
+	syncer := NewSyncer(GroupCommit(time.Hour, 10), func() error {
+		atomic.AddInt32(&syncs, 1)
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() { done <- syncer.Wait(5) }()
+	select {
+	case <-done:
+		t.Fatal("write flushed before threshold")
+	case <-time.After(50 * time.Millisecond):
+	}
+	if err := syncer.Wait(5); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if syncs := atomic.LoadInt32(&syncs); syncs != 1 {
+		t.Fatal("expected one shared flush, got", syncs)
+	}
+}
+
+func TestSyncer_noInterval(t *testing.T) {
+	var syncs int32
+	syncer := NewSyncer(GroupCommit(0, 1024), func() error {
+		atomic.AddInt32(&syncs, 1)
+		return nil
+	})
+	done := make(chan error, 1)
+	go func() { done <- syncer.Wait(1) }()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("write without interval should be flushed immediately")
+	}
+	if syncs := atomic.LoadInt32(&syncs); syncs != 1 {
+		t.Fatal("expected one flush, got", syncs)
+	}
+}
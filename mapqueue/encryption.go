@@ -0,0 +1,270 @@
+package mapqueue
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"golang.org/x/crypto/chacha20poly1305"
+	"io"
+	"sync"
+)
+
+// AEAD cipher for encryption of stored records. Cipher is stored with each record
+type Cipher byte
+
+const (
+	// AES in Galois/Counter mode. Key should be 16, 24 or 32 bytes
+	AESGCM Cipher = 1
+	// ChaCha20-Poly1305. Key should be 32 bytes
+	ChaCha20Poly1305 Cipher = 2
+)
+
+// Source of encryption keys. Each key is identified by id which is stored with encrypted record, so after
+// rotation of current key old records are decrypted by previous keys. Keys should never be changed for same id
+type KeyProvider interface {
+	// Id and value of key for encryption of new records
+	CurrentKey() (id string, key []byte, err error)
+	// Key by id for decryption
+	Key(id string) ([]byte, error)
+}
+
+// Key provider with fixed set of keys
+type StaticKeys struct {
+	Current string            // id of key for encryption
+	Keys    map[string][]byte // all known keys by id
+}
+
+func (sk *StaticKeys) CurrentKey() (string, []byte, error) {
+	key, err := sk.Key(sk.Current)
+	return sk.Current, key, err
+}
+
+func (sk *StaticKeys) Key(id string) ([]byte, error) {
+	key, ok := sk.Keys[id]
+	if !ok {
+		return nil, errors.Errorf("unknown key %q", id)
+	}
+	return key, nil
+}
+
+// marker of encrypted record. Marker is followed by cipher, uvarint length of key id, key id, nonce and sealed data.
+// Marker, cipher, key id, namespace of queue and key of record are authenticated as additional data
+var encryptionMagic = []byte{0, 'E', 'N', 'C'}
+
+// Encrypt new records by cipher with current key of provider. Records are encrypted after compression (see Codec).
+// Encrypted records are readable only with provider of their keys and only in queue with same namespace (see
+// EncryptionNamespace). Records stored without encryption are rejected unless ReadPlaintext is set
+func (qc *QueueConfig) Encrypt(algorithm Cipher, keys KeyProvider) *QueueConfig {
+	qc.encryption = &encryption{algorithm: algorithm, keys: keys, aeads: make(map[aeadKey]cipher.AEAD)}
+	return qc
+}
+
+// Bind encrypted records to namespace (for example name of database), so records copied from queue with other
+// namespace could not be decrypted. Keys prefix of managed queues and priority lanes is added to namespace
+// automatically
+func (qc *QueueConfig) EncryptionNamespace(namespace string) *QueueConfig {
+	qc.namespace = namespace
+	return qc
+}
+
+// Read records stored without encryption (for example written before encryption was enabled). By default such
+// records are rejected if encryption is enabled, so records injected to storage bypassing encryption are not
+// delivered
+func (qc *QueueConfig) ReadPlaintext() *QueueConfig {
+	qc.readPlaintext = true
+	return qc
+}
+
+// namespace of encrypted records: user defined namespace and keys prefix of storage view
+func (qc *QueueConfig) encryptionNamespace() []byte {
+	var prefix []byte
+	for storage := qc.storage; ; {
+		var view *prefixStorage
+		switch s := storage.(type) {
+		case *prefixStorage:
+			view = s
+		case *orderedPrefixStorage:
+			view = s.prefixStorage
+		}
+		if view == nil {
+			break
+		}
+		prefix = append(append([]byte(nil), view.prefix...), prefix...)
+		storage = view.storage
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(qc.namespace)))
+	namespace := make([]byte, 0, n+len(qc.namespace)+len(prefix))
+	namespace = append(namespace, size[:n]...)
+	namespace = append(namespace, qc.namespace...)
+	return append(namespace, prefix...)
+}
+
+type aeadKey struct {
+	algorithm Cipher
+	id        string
+}
+
+// encryption of records with cache of ciphers by key id
+type encryption struct {
+	algorithm Cipher
+	keys      KeyProvider
+	lock      sync.Mutex
+	aeads     map[aeadKey]cipher.AEAD
+}
+
+func (enc *encryption) aead(algorithm Cipher, id string, key []byte) (cipher.AEAD, error) {
+	enc.lock.Lock()
+	defer enc.lock.Unlock()
+	if aead, ok := enc.aeads[aeadKey{algorithm, id}]; ok {
+		return aead, nil
+	}
+	if key == nil {
+		var err error
+		key, err = enc.keys.Key(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var aead cipher.AEAD
+	var err error
+	switch algorithm {
+	case AESGCM:
+		var block cipher.Block
+		block, err = aes.NewCipher(key)
+		if err == nil {
+			aead, err = cipher.NewGCM(block)
+		}
+	case ChaCha20Poly1305:
+		aead, err = chacha20poly1305.New(key)
+	default:
+		err = errors.Errorf("unknown cipher %v", algorithm)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "key %q", id)
+	}
+	enc.aeads[aeadKey{algorithm, id}] = aead
+	return aead, nil
+}
+
+// encryption of records by current key. Prepared before write, so key provider is not called under queue lock
+type sealer struct {
+	aead      cipher.AEAD
+	header    []byte
+	namespace []byte
+}
+
+func (enc *encryption) sealer(namespace []byte) (*sealer, error) {
+	id, key, err := enc.keys.CurrentKey()
+	if err != nil {
+		return nil, errors.Wrap(err, "get current key")
+	}
+	aead, err := enc.aead(enc.algorithm, id, key)
+	if err != nil {
+		return nil, err
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(id)))
+	header := make([]byte, 0, len(encryptionMagic)+1+n+len(id))
+	header = append(header, encryptionMagic...)
+	header = append(header, byte(enc.algorithm))
+	header = append(header, size[:n]...)
+	header = append(header, id...)
+	return &sealer{aead: aead, header: header, namespace: namespace}, nil
+}
+
+// size of encrypted record
+func (s *sealer) size(record []byte) int {
+	return len(s.header) + s.aead.NonceSize() + len(record) + s.aead.Overhead()
+}
+
+// encrypt record which will be stored under the key
+func (s *sealer) seal(key []byte, record []byte) ([]byte, error) {
+	out := make([]byte, len(s.header)+s.aead.NonceSize(), s.size(record))
+	copy(out, s.header)
+	nonce := out[len(s.header):]
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, errors.Wrap(err, "generate nonce")
+	}
+	return s.aead.Seal(out, nonce, record, additionalData(s.header, s.namespace, key)), nil
+}
+
+// decrypt record stored under the key
+func (enc *encryption) open(key []byte, record []byte, namespace []byte) ([]byte, error) {
+	body := record[len(encryptionMagic):]
+	algorithm := Cipher(body[0])
+	size, n := binary.Uvarint(body[1:])
+	if n <= 0 || uint64(len(body)-1-n) < size {
+		return nil, errors.New("broken encryption header")
+	}
+	keyId := string(body[1+n : 1+n+int(size)])
+	headerSize := len(encryptionMagic) + 1 + n + int(size)
+	aead, err := enc.aead(algorithm, keyId, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(record) < headerSize+aead.NonceSize() {
+		return nil, errors.New("broken encrypted record")
+	}
+	nonce := record[headerSize : headerSize+aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, record[headerSize+aead.NonceSize():], additionalData(record[:headerSize], namespace, key))
+	if err != nil {
+		return nil, errors.Wrap(err, "decrypt")
+	}
+	return data, nil
+}
+
+// authenticated data of encrypted record: header, namespace and storage key, so record could not be moved to
+// another key or queue
+func additionalData(header, namespace, key []byte) []byte {
+	data := make([]byte, 0, len(header)+len(namespace)+len(key))
+	data = append(data, header...)
+	data = append(data, namespace...)
+	return append(data, key...)
+}
+
+func isEncrypted(record []byte) bool {
+	return len(record) > len(encryptionMagic)+1 && bytes.HasPrefix(record, encryptionMagic)
+}
+
+// prepare records for storing: compress if enabled. Records are encrypted while writing, when their keys are known
+// (see seal)
+func (j *journal) encode(records [][]byte) ([][]byte, error) {
+	if j.codec == nil {
+		return records, nil
+	}
+	return compressRecords(j.codec, records)
+}
+
+// prepare encryption of records for writing or nil if encryption is disabled
+func (j *journal) sealer() (*sealer, error) {
+	if j.encryption == nil {
+		return nil, nil
+	}
+	return j.encryption.sealer(j.namespace)
+}
+
+// restore stored record: decrypt and decompress if needed
+func (j *journal) decodeRecord(id int64, record []byte) ([]byte, error) {
+	record, err := j.unseal(itemKey(id), record)
+	if err != nil {
+		return nil, errors.Wrapf(err, "item %v", id)
+	}
+	return decompressRecord(id, record)
+}
+
+// decrypt record stored under the key if it is encrypted
+func (j *journal) unseal(key []byte, record []byte) ([]byte, error) {
+	if isEncrypted(record) {
+		if j.encryption == nil {
+			return nil, errors.New("encrypted record requires keys")
+		}
+		return j.encryption.open(key, record, j.namespace)
+	} else if j.encryption != nil && !j.plaintext {
+		return nil, errors.New("record is not encrypted (see QueueConfig.ReadPlaintext)")
+	}
+	return record, nil
+}
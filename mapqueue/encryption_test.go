@@ -0,0 +1,242 @@
+package mapqueue
+
+import (
+	"bytes"
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"testing"
+	"time"
+)
+
+func testKeys(current string) *StaticKeys {
+	return &StaticKeys{Current: current, Keys: map[string][]byte{
+		"k1": bytes.Repeat([]byte{1}, 32),
+		"k2": bytes.Repeat([]byte{2}, 32),
+	}}
+}
+
+func expectItems(t *testing.T, queue *Queue, items ...string) {
+	for _, expected := range items {
+		data, err := queue.HeadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data != expected {
+			t.Fatalf("expected %q, got %q", expected, data)
+		}
+		if err := queue.RemoveN(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestQueue_keyRotation(t *testing.T) {
+	for name, algorithm := range map[string]Cipher{"aes-gcm": AESGCM, "chacha20-poly1305": ChaCha20Poly1305} {
+		t.Run(name, func(t *testing.T) {
+			storage := memstorage.New()
+			queue, err := New(storage).Encrypt(algorithm, testKeys("k1")).Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := queue.PutString("old"); err != nil {
+				t.Fatal(err)
+			}
+			record, err := storage.Get(itemKey(0))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if bytes.Contains(record, []byte("old")) {
+				t.Fatal("record is not encrypted")
+			}
+
+			queue, err = New(storage).Encrypt(algorithm, testKeys("k2")).Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := queue.PutString("new"); err != nil {
+				t.Fatal(err)
+			}
+			expectItems(t, queue, "old", "new")
+
+			if err := queue.PutString("rotated"); err != nil {
+				t.Fatal(err)
+			}
+			keys := testKeys("k1")
+			delete(keys.Keys, "k2")
+			queue, err = New(storage).Encrypt(algorithm, keys).Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := queue.Head(); err == nil {
+				t.Fatal("record should not be readable without its key")
+			}
+		})
+	}
+}
+
+func TestQueue_encryptionNamespace(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).Encrypt(AESGCM, testKeys("k1")).EncryptionNamespace("first").Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("secret"); err != nil {
+		t.Fatal(err)
+	}
+	queue, err = New(storage).Encrypt(AESGCM, testKeys("k1")).EncryptionNamespace("second").Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Head(); err == nil {
+		t.Fatal("record should not be readable in other namespace")
+	}
+
+	// records of managed queues are bound to queue name
+	manager, err := NewManager(storage, func(name string, cfg *QueueConfig) *QueueConfig {
+		return cfg.Encrypt(AESGCM, testKeys("k1"))
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	alpha, err := manager.Create("alpha")
+	if err != nil {
+		t.Fatal(err)
+	}
+	beta, err := manager.Create("beta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alpha.PutString("alpha secret"); err != nil {
+		t.Fatal(err)
+	}
+	if err := beta.PutString("beta secret"); err != nil {
+		t.Fatal(err)
+	}
+	record, err := storage.Get([]byte(managedPrefix + "alpha/" + string(itemKey(0))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put([]byte(managedPrefix+"beta/"+string(itemKey(0))), record); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := beta.Head(); err == nil {
+		t.Fatal("record copied from other queue should not be readable")
+	}
+	expectItems(t, alpha, "alpha secret")
+}
+
+func TestQueue_readPlaintext(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("plain"), append(append([]byte(nil), encryptionMagic...), 1, 2, 3)}); err != nil {
+		t.Fatal(err)
+	}
+	queue, err = New(storage).Encrypt(AESGCM, testKeys("k1")).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Head(); err == nil {
+		t.Fatal("not encrypted record should be rejected")
+	}
+	queue, err = New(storage).Encrypt(AESGCM, testKeys("k1")).ReadPlaintext().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("encrypted"); err != nil {
+		t.Fatal(err)
+	}
+	expectItems(t, queue, "plain", string(encryptionMagic)+"\x01\x02\x03", "encrypted")
+}
+
+func TestQueue_encryptedRecordBoundToId(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).Encrypt(AESGCM, testKeys("k1")).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("first"), []byte("second")}); err != nil {
+		t.Fatal(err)
+	}
+	second, err := storage.Get(itemKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// replay of second record in place of first one
+	if err := storage.Put(itemKey(0), second); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Head(); err == nil {
+		t.Fatal("record moved to other id should not be readable")
+	}
+}
+
+func TestQueue_encryptedDelayedItem(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).Encrypt(AESGCM, testKeys("k1")).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutAfter([]byte("delayed secret"), 50*time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	err = prefixKeys(storage, []byte(schedulePrefix), func(key []byte) error {
+		record, err := storage.Get(key)
+		if err != nil {
+			return err
+		}
+		if bytes.Contains(record, []byte("delayed secret")) {
+			t.Error("delayed record is not encrypted")
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	data, err := queue.Pop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "delayed secret" {
+		t.Fatal("unexpected item", string(data))
+	}
+}
+
+func TestQueue_encryptedDeduplication(t *testing.T) {
+	storage := memstorage.New()
+	open := func() *Queue {
+		queue, err := New(storage).Deduplicate(time.Hour).Encrypt(AESGCM, testKeys("k1")).Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queue
+	}
+	queue := open()
+	if err := queue.PutUnique("order-1", []byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutUnique("", []byte("content")); err != nil {
+		t.Fatal(err)
+	}
+	err := storage.Keys(func(key []byte) error {
+		if bytes.Contains(key, []byte("order-1")) || bytes.Contains(key, []byte("sha256:")) {
+			t.Errorf("deduplication key %q is stored in plain text", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queue = open()
+	if err := queue.PutUnique("order-1", []byte("second")); !IsDuplicate(err) {
+		t.Fatal("expected duplicate by key after restart, got", err)
+	}
+	if err := queue.PutUnique("", []byte("content")); !IsDuplicate(err) {
+		t.Fatal("expected duplicate by content after restart, got", err)
+	}
+}
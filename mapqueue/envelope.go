@@ -0,0 +1,182 @@
+package mapqueue
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"time"
+)
+
+// Item of queue with metadata. Stored items without metadata (put by Put without envelope mode) are represented
+// as envelope with data only. Delivery attempt number is not stored: stream passes it to handlers by context
+// (see strategy.Attempt)
+type Envelope struct {
+	Id      int64             // id of item in queue. Defined by queue
+	Time    time.Time         // enqueue time. Zero if not known
+	Headers map[string]string // arbitrary headers (content type, trace id and etc.)
+	Data    []byte            // payload
+}
+
+// Header value or empty string
+func (env *Envelope) Header(name string) string { return env.Headers[name] }
+
+// marker of item with envelope. Items without marker are raw payloads
+var envelopeMagic = []byte{0, 'E', 'N', 'V'}
+
+// marker of raw payload that starts with one of markers, so it could not be confused with marked record. Removed
+// while reading
+var rawMagic = []byte{0, 'R', 'A', 'W'}
+
+// markers that raw payloads are escaped from
+var markers = [][]byte{envelopeMagic, rawMagic, codecMagic, encryptionMagic}
+
+type envelopeHeader struct {
+	Time    int64             `json:"t,omitempty"`
+	Headers map[string]string `json:"h,omitempty"`
+}
+
+// Put item with metadata to the tail of queue. Enqueue time is set to current time if not defined
+func (q *Queue) PutEnvelope(env *Envelope) error {
+	return q.PutEnvelopeContext(context.Background(), env)
+}
+
+// Put item with metadata to the tail of queue. See PutContext for blocking behaviour
+func (q *Queue) PutEnvelopeContext(ctx context.Context, env *Envelope) error {
+	record, err := encodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	return q.put(ctx, [][]byte{record})
+}
+
+// Up to N items with metadata from head of queue without removing. Missing items (gaps) are skipped
+func (q *Queue) HeadEnvelopes(n int) ([]*Envelope, error) {
+	ids, records, err := q.headRecords(n)
+	if err != nil {
+		return nil, err
+	}
+	var envelopes = make([]*Envelope, len(records))
+	for i, record := range records {
+		envelopes[i], err = q.decodeEnvelope(ids[i], record)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return envelopes, nil
+}
+
+// Get item with metadata by id. See Get
+func (q *Queue) GetEnvelope(id int64) (*Envelope, error) {
+	record, err := q.getRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	return q.decodeEnvelope(id, record)
+}
+
+// wrap payloads to envelopes if envelope mode enabled, otherwise escape payloads that start with markers
+func (q *Queue) wrap(items [][]byte) ([][]byte, error) {
+	if !q.envelopes {
+		return escape(items), nil
+	}
+	now := time.Now()
+	var records = make([][]byte, len(items))
+	for i, data := range items {
+		record, err := encodeEnvelope(&Envelope{Time: now, Data: data})
+		if err != nil {
+			return nil, err
+		}
+		records[i] = record
+	}
+	return records, nil
+}
+
+// prefix raw payloads that start with markers by raw marker. Items are copied only if needed
+func escape(items [][]byte) [][]byte {
+	var records [][]byte
+	for i, data := range items {
+		if !hasMarker(data) {
+			continue
+		}
+		if records == nil {
+			records = append([][]byte(nil), items...)
+		}
+		record := make([]byte, 0, len(rawMagic)+len(data))
+		record = append(record, rawMagic...)
+		records[i] = append(record, data...)
+	}
+	if records == nil {
+		return items
+	}
+	return records
+}
+
+func hasMarker(data []byte) bool {
+	for _, marker := range markers {
+		if bytes.HasPrefix(data, marker) {
+			return true
+		}
+	}
+	return false
+}
+
+func encodeEnvelope(env *Envelope) ([]byte, error) {
+	enqueued := env.Time
+	if enqueued.IsZero() {
+		enqueued = time.Now()
+	}
+	header, err := json.Marshal(&envelopeHeader{Time: enqueued.UnixNano(), Headers: env.Headers})
+	if err != nil {
+		return nil, err
+	}
+	var size [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(size[:], uint64(len(header)))
+	record := make([]byte, 0, len(envelopeMagic)+n+len(header)+len(env.Data))
+	record = append(record, envelopeMagic...)
+	record = append(record, size[:n]...)
+	record = append(record, header...)
+	record = append(record, env.Data...)
+	return record, nil
+}
+
+func (j *journal) decodeEnvelope(id int64, record []byte) (*Envelope, error) {
+	record, err := j.decodeRecord(id, record)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.HasPrefix(record, rawMagic) {
+		return &Envelope{Id: id, Data: record[len(rawMagic):]}, nil
+	}
+	if !bytes.HasPrefix(record, envelopeMagic) {
+		return &Envelope{Id: id, Data: record}, nil
+	}
+	record = record[len(envelopeMagic):]
+	size, n := binary.Uvarint(record)
+	if n <= 0 || uint64(len(record)-n) < size {
+		return nil, errors.Errorf("item %v: broken envelope", id)
+	}
+	var header envelopeHeader
+	if err := json.Unmarshal(record[n:n+int(size)], &header); err != nil {
+		return nil, errors.Wrapf(err, "item %v: decode envelope", id)
+	}
+	env := &Envelope{
+		Id:      id,
+		Headers: header.Headers,
+		Data:    record[n+int(size):],
+	}
+	if header.Time != 0 {
+		env.Time = time.Unix(0, header.Time)
+	}
+	return env, nil
+}
+
+// payload of stored item
+func (j *journal) payload(id int64, record []byte) ([]byte, error) {
+	env, err := j.decodeEnvelope(id, record)
+	if err != nil {
+		return nil, err
+	}
+	return env.Data, nil
+}
@@ -0,0 +1,46 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"testing"
+)
+
+func TestQueue_markedRawPayloads(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []string{
+		string(envelopeMagic) + "\x05{}abc",
+		string(envelopeMagic) + "\xff",
+		string(rawMagic) + "abc",
+		"\x00plain",
+		"plain",
+	}
+	for _, item := range items {
+		if err := queue.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// not marked payloads are stored as is
+	stored, err := storage.Get(itemKey(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stored) != "plain" {
+		t.Fatalf("unexpected stored record %q", stored)
+	}
+	for _, expected := range items {
+		data, err := queue.HeadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data != expected {
+			t.Fatalf("expected %q, got %q", expected, data)
+		}
+		if err := queue.RemoveN(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
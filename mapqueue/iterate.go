@@ -0,0 +1,76 @@
+package mapqueue
+
+import "os"
+
+// Walk over items with ids in range [from, to) in queue order without consuming. Range is limited by items kept in
+// storage (see FirstId and WriteId), so consumed items are visited only if they are still kept. Removed and missing
+// items are skipped. Iteration stops on first error returned by fn and the error is returned.
+// Queue is not locked between items, so concurrent modifications are visible
+func (q *Queue) Range(from, to int64, fn func(id int64, data []byte) error) error {
+	for id := from; ; id++ {
+		data, next, err := q.readFrom(id, to)
+		if err == ErrNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if err := fn(next, data); err != nil {
+			return err
+		}
+		id = next
+	}
+}
+
+// Walk over pending (not consumed) items in queue order without consuming. See Range
+func (q *Queue) Iterate(fn func(id int64, data []byte) error) error {
+	return q.Range(q.ReadId(), q.WriteId(), fn)
+}
+
+// Get pending item by offset from head (0 - head) without consuming. Removed and missing items are not counted.
+// Returns ErrNotFound if queue has no item with such offset (including negative offset)
+func (q *Queue) Peek(offset int64) ([]byte, error) {
+	if offset < 0 {
+		return nil, ErrNotFound
+	}
+	var found []byte
+	err := q.Iterate(func(id int64, data []byte) error {
+		if offset == 0 {
+			found = data
+			return errStopIteration
+		}
+		offset--
+		return nil
+	})
+	if err == errStopIteration {
+		return found, nil
+	} else if err != nil {
+		return nil, err
+	}
+	return nil, ErrNotFound
+}
+
+// read first existent item with id in range [from, to). Returns ErrNotFound if no more items
+func (q *Queue) readFrom(from, to int64) ([]byte, int64, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if from < q.firstId {
+		from = q.firstId
+	}
+	if to > q.writeId {
+		to = q.writeId
+	}
+	for id := from; id < to; id++ {
+		if id >= q.readId && q.committed[id] {
+			continue
+		}
+		data, err := q.storage.Get(itemKey(id))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return nil, 0, err
+		}
+		data, err = q.payload(id, data)
+		return data, id, err
+	}
+	return nil, 0, ErrNotFound
+}
@@ -0,0 +1,91 @@
+package mapqueue
+
+import (
+	"errors"
+	"github.com/reddec/storages/memstorage"
+	"reflect"
+	"testing"
+)
+
+// collect ids and items visited by iteration
+func collect(t *testing.T, iterate func(fn func(id int64, data []byte) error) error) ([]int64, []string) {
+	var ids []int64
+	var items []string
+	err := iterate(func(id int64, data []byte) error {
+		ids = append(ids, id)
+		items = append(items, string(data))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids, items
+}
+
+func TestQueue_IterateAndRange(t *testing.T) {
+	queue, err := New(memstorage.New()).PersistCursor().KeepConsumed(-1).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	// removed out of order
+	if err := queue.Commit(2); err != nil {
+		t.Fatal(err)
+	}
+
+	ids, items := collect(t, queue.Iterate)
+	if !reflect.DeepEqual(ids, []int64{1, 3}) || !reflect.DeepEqual(items, []string{"b", "d"}) {
+		t.Fatal("unexpected pending items:", ids, items)
+	}
+	// consumed but kept items are visited by range
+	ids, items = collect(t, func(fn func(id int64, data []byte) error) error { return queue.Range(-10, 3, fn) })
+	if !reflect.DeepEqual(ids, []int64{0, 1}) || !reflect.DeepEqual(items, []string{"a", "b"}) {
+		t.Fatal("unexpected items in range:", ids, items)
+	}
+
+	stop := errors.New("stop")
+	var visited int
+	err = queue.Iterate(func(id int64, data []byte) error {
+		visited++
+		return stop
+	})
+	if err != stop || visited != 1 {
+		t.Fatal("iteration is not stopped by error:", err, visited)
+	}
+	if queue.Size() != 2 {
+		t.Fatal("iteration consumed items, size", queue.Size())
+	}
+}
+
+func TestQueue_Peek(t *testing.T) {
+	queue, err := NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	// removed items are not counted
+	if err := queue.Commit(1); err != nil {
+		t.Fatal(err)
+	}
+	for offset, expected := range []string{"a", "c"} {
+		data, err := queue.Peek(int64(offset))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("offset %v: expected %v, got %v", offset, expected, string(data))
+		}
+	}
+	for _, offset := range []int64{2, -1} {
+		if _, err := queue.Peek(offset); err != ErrNotFound {
+			t.Fatalf("offset %v: expected not found, got %v", offset, err)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package mapqueue
+
+import (
+	"bytes"
+	"encoding/binary"
+	"strconv"
+)
+
+// prefix of reserved keys for queue metadata. Never intersects with items keys
+const metaPrefix = "meta/"
+
+var cursorKey = []byte(metaPrefix + "cursor")
+
+// prefix of read pointers of named consumers
+const consumerPrefix = metaPrefix + "consumer/"
+
+func consumerKey(name string) []byte { return []byte(consumerPrefix + name) }
+
+// prefix of enqueue time of items. Stored only if max age is limited
+const timePrefix = metaPrefix + "time/"
+
+func timeKey(id int64) []byte { return appendId([]byte(timePrefix), id) }
+
+// format of keys. If not defined, keys could be in legacy (decimal) format
+var formatKey = []byte(metaPrefix + "format")
+
+const binaryFormat = "binary"
+
+// bounds of items and list of consumers for fast opening
+var layoutKey = []byte(metaPrefix + "layout")
+
+// prefix of items keys. Item key is prefix and 8 bytes big-endian id, so byte order of keys is the queue order
+const itemPrefix = "q"
+
+func itemKey(id int64) []byte { return appendId([]byte(itemPrefix), id) }
+
+func parseItemKey(key []byte) (int64, bool) { return parseId(key, itemPrefix) }
+
+func appendId(prefix []byte, id int64) []byte {
+	var raw [8]byte
+	binary.BigEndian.PutUint64(raw[:], uint64(id))
+	return append(prefix, raw[:]...)
+}
+
+func parseId(key []byte, prefix string) (int64, bool) {
+	if len(key) != len(prefix)+8 || !bytes.HasPrefix(key, []byte(prefix)) {
+		return 0, false
+	}
+	return int64(binary.BigEndian.Uint64(key[len(prefix):])), true
+}
+
+// items keys before binary format: decimal id
+func parseLegacyItemKey(key []byte) (int64, bool) {
+	id, err := strconv.ParseInt(string(key), 10, 64)
+	return id, err == nil
+}
+
+// time keys before binary format: decimal id. Suffix of 8 digits is valid binary id too, so keys of storage which is
+// not migrated yet should be parsed by this function first
+func parseLegacyTimeKey(key []byte) (int64, bool) {
+	if !bytes.HasPrefix(key, []byte(timePrefix)) || !isDecimal(key[len(timePrefix):]) {
+		return 0, false
+	}
+	id, err := strconv.ParseInt(string(key[len(timePrefix):]), 10, 64)
+	return id, err == nil
+}
+
+func isDecimal(data []byte) bool {
+	for _, c := range data {
+		if c < '0' || c > '9' {
+			return false
+		}
+	}
+	return len(data) > 0
+}
+
+func isMetaKey(key []byte) bool { return bytes.HasPrefix(key, []byte(metaPrefix)) }
+
+func encodeInt(value int64) []byte { return []byte(strconv.FormatInt(value, 10)) }
+
+func decodeInt(data []byte) (int64, error) { return strconv.ParseInt(string(data), 10, 64) }
@@ -0,0 +1,120 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/reddec/storages"
+	"github.com/reddec/storages/memstorage"
+	"strconv"
+	"testing"
+)
+
+// open queue over storage and check that it contains expected items and only binary keys
+func checkMigrated(t *testing.T, storage storages.Storage, expected ...string) {
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, err := storage.Get(formatKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(format) != binaryFormat {
+		t.Fatal("storage is not marked as migrated")
+	}
+	err = storage.Keys(func(key []byte) error {
+		if _, ok := parseLegacyItemKey(key); ok {
+			t.Errorf("legacy key %q left after migration", key)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range expected {
+		data, err := queue.Pop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != item {
+			t.Fatalf("expected %v, got %v", item, string(data))
+		}
+	}
+	if !queue.Empty() {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestOpen_migrateLegacyKeys(t *testing.T) {
+	storage := memstorage.New()
+	// decimal keys are not in queue order by bytes: 9 > 10
+	for id, item := range map[int64]string{9: "a", 10: "b", 11: "c"} {
+		if err := storage.Put([]byte(strconv.FormatInt(id, 10)), []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	legacyTime := []byte(timePrefix + "10")
+	if err := storage.Put(legacyTime, encodeInt(123)); err != nil {
+		t.Fatal(err)
+	}
+	checkMigrated(t, storage, "a", "b", "c")
+	if _, err := storage.Get(legacyTime); err == nil {
+		t.Fatal("legacy time key left after migration")
+	}
+	data, err := storage.Get(timeKey(10))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "123" {
+		t.Fatal("time meta record changed:", string(data))
+	}
+}
+
+func TestOpen_continueInterruptedMigration(t *testing.T) {
+	storage := memstorage.New()
+	// first chunk is migrated, but storage is not marked as migrated yet
+	for id, item := range map[int64]string{9: "a", 10: "b"} {
+		if err := storage.Put(itemKey(id), []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for id, item := range map[int64]string{11: "c", 12: "d"} {
+		if err := storage.Put([]byte(strconv.FormatInt(id, 10)), []byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkMigrated(t, storage, "a", "b", "c", "d")
+}
+
+func TestOpen_migrateEightDigitsIds(t *testing.T) {
+	storage := memstorage.New()
+	// 8 digits suffix of time key has the same length as binary id
+	const id = 12345678
+	legacyKey := []byte(strconv.FormatInt(id, 10))
+	legacyTime := []byte(timePrefix + strconv.FormatInt(id, 10))
+	if err := storage.Put(legacyKey, []byte("a")); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(legacyTime, encodeInt(123)); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() {
+		t.Fatalf("legacy storage reported as damaged: %+v", report)
+	}
+
+	checkMigrated(t, storage, "a")
+	if _, err := storage.Get(legacyTime); err == nil {
+		t.Fatal("legacy time key left after migration")
+	}
+	data, err := storage.Get(timeKey(id))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "123" {
+		t.Fatal("time meta record changed:", string(data))
+	}
+}
@@ -0,0 +1,192 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"os"
+	"time"
+)
+
+// The error occurred after acknowledge of lease that was expired and taken by someone else
+var ErrLeaseLost = errors.New("lease lost")
+
+// Leased item of queue. Item is invisible for other Take calls till lease is acknowledged, rejected or expired
+type Lease struct {
+	Id       int64     // id of item
+	Data     []byte    // item value
+	Deadline time.Time // lease expiration time. Zero if lease never expires
+	Envelope *Envelope // item with metadata
+	queue    *Queue
+}
+
+// Acknowledge processing: remove item from queue (see Queue.Commit)
+func (l *Lease) Ack() error {
+	q := l.queue
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.leases[l.Id] != l {
+		return ErrLeaseLost
+	}
+	delete(q.leases, l.Id)
+	if l.Id < q.readId || q.committed[l.Id] {
+		return nil
+	}
+	return q.remove([]int64{l.Id})
+}
+
+// Reject processing: return item to queue for next Take
+func (l *Lease) Nack() error {
+	q := l.queue
+	q.lock.Lock()
+	if q.leases[l.Id] != l {
+		q.lock.Unlock()
+		return ErrLeaseLost
+	}
+	delete(q.leases, l.Id)
+	q.lock.Unlock()
+	q.onCreated.notify()
+	return nil
+}
+
+func (l *Lease) expired(now time.Time) bool { return !l.Deadline.IsZero() && !now.Before(l.Deadline) }
+
+// Wait till queue will have at least one item or context will be canceled
+func (q *Queue) Wait(ctx context.Context) error {
+	sub := q.onCreated.Subscribe()
+	defer sub.Close()
+	for q.Empty() {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-sub.Wait():
+
+		}
+	}
+	return nil
+}
+
+// Wait for item which is not leased, get and remove it from head of queue. Item is lost if processing failed
+func (q *Queue) Pop(ctx context.Context) ([]byte, error) {
+	sub := q.onCreated.Subscribe()
+	defer sub.Close()
+	for {
+		data, ok, wait, err := q.pop()
+		if ok || err != nil {
+			return data, err
+		}
+		if err := q.waitAvailable(ctx, sub, wait); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (q *Queue) pop() ([]byte, bool, time.Duration, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	id, data, wait, err := q.available(time.Now())
+	if err != nil || data == nil {
+		return nil, false, wait, err
+	}
+	data, err = q.payload(id, data)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	return data, true, 0, q.remove([]int64{id})
+}
+
+// Wait for item which is not leased yet and lease it for ttl (zero means forever). Item should be acknowledged
+// (removed) or rejected (returned to queue) by lease. Expired leases are returned to queue automatically
+func (q *Queue) Take(ctx context.Context, ttl time.Duration) (*Lease, error) {
+	sub := q.onCreated.Subscribe()
+	defer sub.Close()
+	for {
+		lease, wait, err := q.take(ttl)
+		if lease != nil || err != nil {
+			return lease, err
+		}
+		err = q.waitAvailable(ctx, sub, wait)
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// lease first available item. If no items available, returns time till nearest lease expiration (or 0)
+func (q *Queue) take(ttl time.Duration) (*Lease, time.Duration, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.leases == nil {
+		q.leases = make(map[int64]*Lease)
+	}
+	for id := range q.leases {
+		if id < q.readId {
+			delete(q.leases, id)
+		}
+	}
+	now := time.Now()
+	id, data, wait, err := q.available(now)
+	if err != nil || data == nil {
+		return nil, wait, err
+	}
+	env, err := q.decodeEnvelope(id, data)
+	if err != nil {
+		return nil, 0, err
+	}
+	lease := &Lease{Id: id, Data: env.Data, Envelope: env, queue: q}
+	if ttl > 0 {
+		lease.Deadline = now.Add(ttl)
+	}
+	q.leases[id] = lease
+	return lease, 0, nil
+}
+
+// first not committed and not leased item (raw record). If no items available, returns time till nearest lease
+// expiration (or 0). Should be called under lock
+func (q *Queue) available(now time.Time) (int64, []byte, time.Duration, error) {
+	if err := q.expire(); err != nil {
+		return 0, nil, 0, err
+	}
+	var wait time.Duration
+	for id := q.readId; id < q.writeId; id++ {
+		if q.committed[id] {
+			continue
+		}
+		if lease, ok := q.leases[id]; ok && !lease.expired(now) {
+			if left := lease.Deadline.Sub(now); !lease.Deadline.IsZero() && (wait == 0 || left < wait) {
+				wait = left
+			}
+			continue
+		}
+		data, err := q.storage.Get(itemKey(id))
+		if os.IsNotExist(err) {
+			if err := q.gap(id); err != nil {
+				return 0, nil, 0, err
+			}
+			continue
+		} else if err != nil {
+			return 0, nil, 0, err
+		}
+		if data == nil {
+			data = []byte{}
+		}
+		return id, data, 0, nil
+	}
+	return 0, nil, wait, nil
+}
+
+// wait for new items or nearest lease expiration (if wait is positive)
+func (q *Queue) waitAvailable(ctx context.Context, sub *Subscription, wait time.Duration) error {
+	var expired <-chan time.Time
+	if wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sub.Wait():
+	case <-expired:
+	}
+	return nil
+}
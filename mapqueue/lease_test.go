@@ -0,0 +1,54 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"testing"
+	"time"
+)
+
+func TestQueue_PopSkipsLeased(t *testing.T) {
+	q, err := New(memstorage.New()).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"x", "y"} {
+		if err := q.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	lease, err := q.Take(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(lease.Data) != "x" {
+		t.Fatal("expected x, got", string(lease.Data))
+	}
+	data, err := q.Pop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "y" {
+		t.Fatal("expected y, got", string(data))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := q.Pop(ctx); err != context.DeadlineExceeded {
+		t.Fatal("leased item should not be popped:", err)
+	}
+
+	if err := lease.Nack(); err != nil {
+		t.Fatal(err)
+	}
+	data, err = q.Pop(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "x" {
+		t.Fatal("expected x, got", string(data))
+	}
+	if !q.Empty() {
+		t.Fatal("queue should be empty")
+	}
+}
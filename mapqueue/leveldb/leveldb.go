@@ -0,0 +1,98 @@
+// Package leveldb provides LevelDB storage for mapqueue with all optional extensions: atomic batches
+// (mapqueue.BatchStorage), flushing to disk (mapqueue.SyncStorage) and ordered iteration (mapqueue.OrderedStorage)
+package leveldb
+
+import (
+	"github.com/reddec/wal/mapqueue"
+	goleveldb "github.com/syndtr/goleveldb/leveldb"
+	"github.com/syndtr/goleveldb/leveldb/opt"
+	"github.com/syndtr/goleveldb/leveldb/util"
+	"os"
+)
+
+// key of synced write. Placed under reserved meta prefix of mapqueue so it never intersects with items
+var syncKey = []byte("meta/sync")
+
+// LevelDB storage. Missing keys are reported as os.ErrNotExist
+type Storage struct {
+	db *goleveldb.DB
+}
+
+// Open (or create) LevelDB database in directory
+func New(path string) (*Storage, error) {
+	db, err := goleveldb.OpenFile(path, nil)
+	if err != nil {
+		return nil, err
+	}
+	return &Storage{db: db}, nil
+}
+
+func (s *Storage) Put(key []byte, data []byte) error { return s.db.Put(key, data, nil) }
+
+func (s *Storage) Get(key []byte) ([]byte, error) {
+	data, err := s.db.Get(key, nil)
+	if err == goleveldb.ErrNotFound {
+		return nil, os.ErrNotExist
+	}
+	return data, err
+}
+
+func (s *Storage) Del(key []byte) error { return s.db.Delete(key, nil) }
+
+func (s *Storage) Keys(handler func(key []byte) error) error {
+	return s.iterate(nil, false, handler)
+}
+
+func (s *Storage) Close() error { return s.db.Close() }
+
+// Apply all operations of batch atomically
+func (s *Storage) WriteBatch(batch *mapqueue.Batch) error {
+	var native goleveldb.Batch
+	err := batch.Replay(func(key []byte, data []byte) error {
+		native.Put(key, data)
+		return nil
+	}, func(key []byte) error {
+		native.Delete(key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.db.Write(&native, nil)
+}
+
+// Flush all written data to disk. LevelDB has no explicit flush, however synced write flushes journal with all
+// previous writes
+func (s *Storage) Sync() error {
+	return s.db.Put(syncKey, nil, &opt.WriteOptions{Sync: true})
+}
+
+// Iterate over keys with prefix in byte order
+func (s *Storage) Range(prefix []byte, reverse bool, handler func(key []byte) error) error {
+	return s.iterate(prefix, reverse, handler)
+}
+
+func (s *Storage) iterate(prefix []byte, reverse bool, handler func(key []byte) error) error {
+	var slice *util.Range
+	if prefix != nil {
+		slice = util.BytesPrefix(prefix)
+	}
+	it := s.db.NewIterator(slice, nil)
+	defer it.Release()
+	next := it.Next
+	if reverse {
+		if !it.Last() {
+			return it.Error()
+		}
+		if err := handler(append([]byte(nil), it.Key()...)); err != nil {
+			return err
+		}
+		next = it.Prev
+	}
+	for next() {
+		if err := handler(append([]byte(nil), it.Key()...)); err != nil {
+			return err
+		}
+	}
+	return it.Error()
+}
@@ -0,0 +1,83 @@
+package leveldb
+
+import (
+	"github.com/reddec/wal/mapqueue"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestStorage_Queue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := mapqueue.New(storage).Durability(mapqueue.SyncAlways()).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	storage, err = New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	queue, err = mapqueue.NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queue.Size() != 2 {
+		t.Fatal("expected 2 items, got", queue.Size())
+	}
+	if head, err := queue.HeadString(); err != nil || head != "b" {
+		t.Fatal("unexpected head", head, err)
+	}
+	if _, err := storage.Get([]byte("missing")); !os.IsNotExist(err) {
+		t.Fatal("expected not exist error, got", err)
+	}
+}
+
+func TestStorage_Range(t *testing.T) {
+	dir, err := ioutil.TempDir("", "leveldb")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	storage, err := New(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer storage.Close()
+	batch := &mapqueue.Batch{}
+	for _, key := range []string{"a1", "a3", "a2", "b1"} {
+		batch.Put([]byte(key), []byte(key))
+	}
+	if err := storage.WriteBatch(batch); err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	err = storage.Range([]byte("a"), true, func(key []byte) error {
+		keys = append(keys, string(key))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] != "a3" || keys[2] != "a1" {
+		t.Fatal("unexpected keys", keys)
+	}
+}
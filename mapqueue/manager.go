@@ -0,0 +1,188 @@
+package mapqueue
+
+import (
+	"encoding/json"
+	"github.com/pkg/errors"
+	"github.com/reddec/storages"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Queue with requested name is not registered in manager
+var ErrUnknownQueue = errors.New("unknown queue")
+
+// Queue with requested name is already registered in manager
+var ErrQueueExists = errors.New("queue already exists")
+
+// JSON list of registered names. Key is outside of managedPrefix, so it does not clash with keys of any queue name
+var registryKey = []byte(metaPrefix + "manager/queues")
+
+// prefix of keys of managed queues. Queue keys are prefix, name and slash
+const managedPrefix = metaPrefix + "manager/queue/"
+
+// Hosts many named queues in one storage. Each queue owns keys under own prefix and has independent pointers,
+// limits and notifications. Thread safe
+type Manager struct {
+	storage storages.Storage
+	setup   func(name string, cfg *QueueConfig) *QueueConfig
+	lock    sync.Mutex
+	names   map[string]bool
+	opened  map[string]*Queue
+}
+
+// Create manager of queues over storage. Setup function (if defined) configures builder of each queue before
+// opening, for example: func(name string, cfg *QueueConfig) *QueueConfig { return cfg.PersistCursor() }
+func NewManager(storage storages.Storage, setup func(name string, cfg *QueueConfig) *QueueConfig) (*Manager, error) {
+	m := &Manager{
+		storage: storage,
+		setup:   setup,
+		names:   make(map[string]bool),
+		opened:  make(map[string]*Queue),
+	}
+	data, err := storage.Get(registryKey)
+	if os.IsNotExist(err) {
+		return m, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var names []string
+	if err := json.Unmarshal(data, &names); err != nil {
+		return nil, errors.Wrap(err, "decode list of queues")
+	}
+	for _, name := range names {
+		m.names[name] = true
+	}
+	return m, nil
+}
+
+// Create and open new queue. Returns ErrQueueExists if queue already registered
+func (m *Manager) Create(name string) (*Queue, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errors.Errorf("invalid queue name %q", name)
+	}
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.names[name] {
+		return nil, ErrQueueExists
+	}
+	m.names[name] = true
+	if err := m.saveRegistry(); err != nil {
+		delete(m.names, name)
+		return nil, err
+	}
+	return m.open(name)
+}
+
+// Open registered queue. Same queue instance is returned for each call. Returns ErrUnknownQueue if queue is not
+// registered
+func (m *Manager) Open(name string) (*Queue, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.names[name] {
+		return nil, ErrUnknownQueue
+	}
+	return m.open(name)
+}
+
+// Names of registered queues in alphabetical order
+func (m *Manager) List() []string {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var names = make([]string, 0, len(m.names))
+	for name := range m.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Delete queue with all items and pointers. Opened instance of queue should not be used after deletion
+func (m *Manager) Delete(name string) error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if !m.names[name] {
+		return ErrUnknownQueue
+	}
+	if q, ok := m.opened[name]; ok {
+		q.stopSchedule()
+		delete(m.opened, name)
+	}
+	prefix := []byte(managedPrefix + name + "/")
+	var keys [][]byte
+	err := prefixKeys(m.storage, prefix, func(key []byte) error {
+		keys = append(keys, append([]byte(nil), key...))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	const chunk = 1024
+	batch := &Batch{}
+	for i, key := range keys {
+		batch.Del(key)
+		if batch.Len() < chunk && i < len(keys)-1 {
+			continue
+		}
+		if err := writeBatch(m.storage, batch); err != nil {
+			return err
+		}
+		batch = &Batch{}
+	}
+	delete(m.names, name)
+	if err := m.saveRegistry(); err != nil {
+		m.names[name] = true
+		return err
+	}
+	return nil
+}
+
+// Close all opened queues. See Queue.Close. Storage is not closed
+func (m *Manager) Close() error {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	var lastErr error
+	for name, q := range m.opened {
+		if err := q.Close(); err != nil {
+			lastErr = err
+		}
+		delete(m.opened, name)
+	}
+	return lastErr
+}
+
+// open queue or get already opened. Should be called under lock
+func (m *Manager) open(name string) (*Queue, error) {
+	if q, ok := m.opened[name]; ok {
+		return q, nil
+	}
+	cfg := New(m.storage)
+	if m.setup != nil {
+		cfg = m.setup(name, cfg)
+	}
+	if err := checkDurability(m.storage, cfg.durability); err != nil {
+		return nil, err
+	}
+	cfg.storage = prefixed(m.storage, managedPrefix+name+"/")
+	q, err := cfg.Open()
+	if err != nil {
+		return nil, errors.Wrapf(err, "open queue %v", name)
+	}
+	m.opened[name] = q
+	return q, nil
+}
+
+// persist list of queues. Should be called under lock
+func (m *Manager) saveRegistry() error {
+	var names = make([]string, 0, len(m.names))
+	for name := range m.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	data, err := json.Marshal(names)
+	if err != nil {
+		return err
+	}
+	return m.storage.Put(registryKey, data)
+}
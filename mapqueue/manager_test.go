@@ -0,0 +1,156 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"reflect"
+	"testing"
+)
+
+func TestManager_sharedStorage(t *testing.T) {
+	storage := memstorage.New()
+	manager, err := NewManager(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	managed, err := manager.Create("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := managed.PutString("job"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Repair(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() || report.Quarantined != 0 {
+		t.Fatalf("manager keys should not be reported: %+v", report)
+	}
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Empty() {
+		t.Fatal("regular queue should not see managed items")
+	}
+	if err := manager.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	manager, err = NewManager(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := manager.List(); len(names) != 1 || names[0] != "jobs" {
+		t.Fatal("unexpected list of queues:", names)
+	}
+	managed, err = manager.Open("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := managed.HeadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "job" {
+		t.Fatal("expected job, got", data)
+	}
+}
+
+func TestManager_names(t *testing.T) {
+	manager, err := NewManager(memstorage.New(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"", "a/b"} {
+		if _, err := manager.Create(name); err == nil {
+			t.Fatalf("invalid name %q should be rejected", name)
+		}
+	}
+	if _, err := manager.Create("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := manager.Create("jobs"); err != ErrQueueExists {
+		t.Fatal("expected ErrQueueExists, got", err)
+	}
+	if _, err := manager.Open("mails"); err != ErrUnknownQueue {
+		t.Fatal("expected ErrUnknownQueue, got", err)
+	}
+	// names which look like keys of manager or other queues do not clash
+	for _, name := range []string{"queues", "queue", "jobs2"} {
+		managed, err := manager.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := managed.PutString(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	jobs, err := manager.Open("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jobs.Empty() {
+		t.Fatal("queue sees items of queue with similar name")
+	}
+	if names := manager.List(); !reflect.DeepEqual(names, []string{"jobs", "jobs2", "queue", "queues"}) {
+		t.Fatal("unexpected list of queues:", names)
+	}
+}
+
+func TestManager_Delete(t *testing.T) {
+	storage := memstorage.New()
+	manager, err := NewManager(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"jobs", "mails"} {
+		managed, err := manager.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := managed.PutString(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := manager.Delete("jobs"); err != nil {
+		t.Fatal(err)
+	}
+	if err := manager.Delete("jobs"); err != ErrUnknownQueue {
+		t.Fatal("expected ErrUnknownQueue, got", err)
+	}
+	var left int
+	err = prefixKeys(storage, []byte(managedPrefix+"jobs/"), func(key []byte) error {
+		left++
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if left != 0 {
+		t.Fatal("keys of deleted queue are left:", left)
+	}
+
+	manager, err = NewManager(storage, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if names := manager.List(); !reflect.DeepEqual(names, []string{"mails"}) {
+		t.Fatal("unexpected list of queues after reopen:", names)
+	}
+	mails, err := manager.Open("mails")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, err := mails.HeadString(); err != nil || data != "mails" {
+		t.Fatal("items of other queue are affected:", data, err)
+	}
+	// queue with the same name is created empty
+	jobs, err := manager.Create("jobs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !jobs.Empty() {
+		t.Fatal("recreated queue is not empty, size", jobs.Size())
+	}
+}
@@ -1,61 +1,236 @@
 package mapqueue
 
 import (
+	"context"
 	"github.com/pkg/errors"
 	"github.com/reddec/storages"
-	"math"
-	"strconv"
+	"os"
 	"sync"
+	"time"
 )
 
 // The error occurred after access to empty queue
 var ErrEmpty = errors.New("queue is empty")
 
-// Queue with map-based storage. Thread safe
+// The error occurred after access to item that is not in queue (already removed or not yet written)
+var ErrNotFound = errors.New("item not found")
+
+// Queue with map-based storage. Thread safe. Each queue is a read cursor over shared storage: default one
+// is returned by constructor, named ones - by Consumer
 type Queue struct {
+	*journal
+	name      string // consumer name. Empty for default consumer
+	readId    int64
+	committed map[int64]bool   // items removed out of order (see Commit)
+	leases    map[int64]*Lease // taken items (see Take)
+
+	dequeued    int64 // number of items removed by consumer since opening
+	dequeueRate rateMeter
+}
+
+// state shared by all consumers of the same storage
+type journal struct {
 	onCreated Notification
 	storage   storages.Storage
 	lock      sync.RWMutex
-	readId    int64
+	firstId   int64 // oldest item in storage (less then readId only if cursor is persisted)
 	writeId   int64
+	consumers map[string]*Queue // all consumers including default one
+
+	durable      bool  // persist read pointer
+	keepConsumed int64 // number of consumed items to keep in durable mode
+
+	onRemoved Notification
+
+	limits limits
+	index  *itemIndex // only if limits are defined or size tracking is enabled
+	syncer *Syncer
+	logger Logger
+	gaps   int64 // number of skipped missing items
+
+	enqueued    int64 // number of items put since opening
+	enqueueRate rateMeter
+
+	layoutFirst int64 // bounds in persisted layout
+	layoutNext  int64
+
+	envelopes  bool        // wrap payloads to envelopes
+	codec      Codec       // compression of new records. Nil if disabled
+	encryption *encryption // encryption of records. Nil if disabled
+	namespace  []byte      // authenticated namespace of encrypted records
+	plaintext  bool        // accept not encrypted records if encryption is enabled
+
+	scheduler *scheduler  // delayed items
+	dedup     *dedupIndex // keys of unique items. Nil if deduplication is disabled
+}
+
+// General logger interface
+type Logger interface {
+	// Print items in line
+	Println(...interface{})
 }
 
 // Get notifications manager for new items event
 func (q *Queue) OnCreated() *Notification { return &q.onCreated }
 
+// Get notifications manager for removed items event (by any consumer or by retention)
+func (q *Queue) OnRemoved() *Notification { return &q.onRemoved }
+
 // Check is queue empty
-func (q *Queue) Empty() bool { return q.readId >= q.writeId }
+func (q *Queue) Empty() bool {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.readId >= q.writeId
+}
 
 // Size of queue
-func (q *Queue) Size() int64 { return q.writeId - q.readId }
+func (q *Queue) Size() int64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.size()
+}
 
-// Put data to the tail of queue
-func (q *Queue) Put(data []byte) error {
-	q.lock.Lock()
-	id := strconv.FormatInt(q.writeId, 10)
-	err := q.storage.Put([]byte(id), data)
+// number of items available for consumer: committed out of order items are not counted. Lock must be held
+func (q *Queue) size() int64 {
+	return q.writeId - q.readId - int64(len(q.committed))
+}
+
+// Id of head item (next item to read)
+func (q *Queue) ReadId() int64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.readId
+}
+
+// Id of oldest item kept in storage. Differs from ReadId only if read pointer is persisted and consumed items
+// are kept (see QueueConfig.PersistCursor)
+func (q *Queue) FirstId() int64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.firstId
+}
+
+// Id of next item that will be written
+func (q *Queue) WriteId() int64 {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	return q.writeId
+}
+
+// Put data to the tail of queue. If limits are reached, behaviour is defined by overflow policy
+// (see QueueConfig.Limit)
+func (q *Queue) Put(data []byte) error { return q.PutContext(context.Background(), data) }
+
+// Put data to the tail of queue. If limits are reached and overflow policy is Block, waits till
+// items will be removed or context will be canceled
+func (q *Queue) PutContext(ctx context.Context, data []byte) error {
+	records, err := q.wrap([][]byte{data})
 	if err != nil {
-		q.lock.Unlock()
 		return err
 	}
-	q.writeId++
-	q.lock.Unlock()
-	q.onCreated.notify()
-	return nil
+	return q.put(ctx, records)
 }
 
 // Put string to the tail of a queue
 func (q *Queue) PutString(data string) error { return q.Put([]byte(data)) }
 
-// Head value of queue
+// Put several items to the tail of queue. Items are written atomically if storage supports batches
+// (see BatchStorage). Subscribers are notified once per batch
+func (q *Queue) PutBatch(items [][]byte) error {
+	records, err := q.wrap(items)
+	if err != nil {
+		return err
+	}
+	return q.put(context.Background(), records)
+}
+
+// put records (items as they stored)
+func (j *journal) put(ctx context.Context, items [][]byte) error {
+	records, err := j.encode(items)
+	if err != nil {
+		return err
+	}
+	return j.putWith(ctx, records, &Batch{})
+}
+
+// put encoded records (see encode) and write additional operations from batch atomically with them. Records are
+// encrypted here if encryption is enabled
+func (j *journal) putWith(ctx context.Context, items [][]byte, batch *Batch) error {
+	if len(items) == 0 {
+		return nil
+	}
+	seal, err := j.sealer()
+	if err != nil {
+		return err
+	}
+	var size int64
+	for _, data := range items {
+		if seal != nil {
+			size += int64(seal.size(data))
+		} else {
+			size += int64(len(data))
+		}
+	}
+	j.lock.Lock()
+	err = j.reserve(ctx, int64(len(items)), size)
+	if err != nil {
+		j.lock.Unlock()
+		return err
+	}
+	now := time.Now()
+	records := items
+	if seal != nil {
+		records = make([][]byte, len(items))
+	}
+	for i, data := range items {
+		id := j.writeId + int64(i)
+		if seal != nil {
+			// encrypted record is bound to its key, so id should be known
+			if data, err = seal.seal(itemKey(id), data); err != nil {
+				j.lock.Unlock()
+				return err
+			}
+			records[i] = data
+		}
+		batch.Put(itemKey(id), data)
+		if j.limits.maxAge > 0 {
+			batch.Put(timeKey(id), encodeInt(now.UnixNano()))
+		}
+	}
+	saveLayout := j.driftLayout(batch, j.firstId, j.writeId+int64(len(items)))
+	err = writeBatch(j.storage, batch)
+	if err != nil {
+		j.lock.Unlock()
+		return err
+	}
+	if saveLayout {
+		j.layoutFirst, j.layoutNext = j.firstId, j.writeId+int64(len(items))
+	}
+	j.writeId += int64(len(items))
+	j.enqueued += int64(len(items))
+	j.enqueueRate.add(int64(len(items)), now)
+	if j.index != nil {
+		for _, data := range records {
+			j.index.add(int64(len(data)), now)
+		}
+	}
+	j.lock.Unlock()
+	if err = j.syncer.Wait(size); err != nil {
+		// data is already in storage and will be delivered
+		j.onCreated.notify()
+		return err
+	}
+	j.onCreated.notify()
+	return nil
+}
+
+// Head value of queue. Missing items (gaps) are skipped
 func (q *Queue) Head() ([]byte, error) {
-	if q.Empty() {
-		return nil, ErrEmpty
+	items, err := q.HeadN(1)
+	if err != nil {
+		return nil, err
 	}
-	q.lock.RLock()
-	defer q.lock.RUnlock()
-	id := strconv.FormatInt(q.readId, 10)
-	return q.storage.Get([]byte(id))
+	return items[0], nil
 }
 
 // Get value as string from head
@@ -64,6 +239,106 @@ func (q *Queue) HeadString() (string, error) {
 	return string(v), err
 }
 
+// Up to N values from head of queue without removing. Missing items (gaps) are skipped
+func (q *Queue) HeadN(n int) ([][]byte, error) {
+	_, items, err := q.HeadIds(n)
+	return items, err
+}
+
+// Up to N values with their ids from head of queue without removing. Missing items (gaps) are skipped, so ids
+// could be not contiguous
+func (q *Queue) HeadIds(n int) ([]int64, [][]byte, error) {
+	ids, records, err := q.headRecords(n)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i, record := range records {
+		records[i], err = q.payload(ids[i], record)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	return ids, records, nil
+}
+
+// up to N records with ids from head of queue. Missing items are skipped
+func (q *Queue) headRecords(n int) ([]int64, [][]byte, error) {
+	for {
+		if err := q.expireLocked(); err != nil {
+			return nil, nil, err
+		}
+		if q.Empty() {
+			return nil, nil, ErrEmpty
+		}
+		ids, records, missing, err := q.headN(n)
+		if err == nil || !os.IsNotExist(err) {
+			return ids, records, err
+		}
+		if err := q.skipGap(missing); err != nil {
+			return nil, nil, err
+		}
+	}
+}
+
+// read up to N records from head. Returns id of missing item with not-exists error
+func (q *Queue) headN(n int) ([]int64, [][]byte, int64, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	ids := q.pending(n)
+	if len(ids) == 0 {
+		return nil, nil, 0, ErrEmpty
+	}
+	var records = make([][]byte, 0, len(ids))
+	for _, id := range ids {
+		data, err := q.storage.Get(itemKey(id))
+		if err != nil {
+			return nil, nil, id, err
+		}
+		records = append(records, data)
+	}
+	return ids, records, 0, nil
+}
+
+// skip missing item if it is still pending
+func (q *Queue) skipGap(id int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if id < q.readId || id >= q.writeId || q.committed[id] {
+		return nil
+	}
+	return q.gap(id)
+}
+
+// count and skip missing item. Should be called under write lock
+func (q *Queue) gap(id int64) error {
+	q.gaps++
+	q.logger.Println("item", id, "is missing in storage and skipped (total gaps:", q.gaps, ")")
+	return q.remove([]int64{id})
+}
+
+// Get item by id. Returns ErrNotFound if item is out of queue or already removed. Consumed items that are still
+// kept in storage (see QueueConfig.KeepConsumed) are available too
+func (q *Queue) Get(id int64) ([]byte, error) {
+	record, err := q.getRecord(id)
+	if err != nil {
+		return nil, err
+	}
+	return q.payload(id, record)
+}
+
+func (q *Queue) getRecord(id int64) ([]byte, error) {
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	if id < q.firstId || id >= q.writeId || (id >= q.readId && q.committed[id]) {
+		return nil, ErrNotFound
+	}
+	data, err := q.storage.Get(itemKey(id))
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
 // Remove head item from queue
 func (q *Queue) Remove() error {
 	if q.Empty() {
@@ -71,42 +346,129 @@ func (q *Queue) Remove() error {
 	}
 	q.lock.Lock()
 	defer q.lock.Unlock()
-	id := strconv.FormatInt(q.readId, 10)
-	err := q.storage.Del([]byte(id))
+	return q.remove([]int64{q.readId})
+}
+
+// Remove up to N items from head of queue. Items are removed atomically if storage supports batches
+// (see BatchStorage)
+func (q *Queue) RemoveN(n int) error {
+	if q.Empty() || n <= 0 {
+		return nil
+	}
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.remove(q.pending(n))
+}
+
+// Remove item by id out of order. Item is removed from storage immediately, but read pointer moves only over
+// contiguous prefix of removed items. Removing of unknown or already removed item is no-op
+func (q *Queue) Commit(id int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if id < q.readId || id >= q.writeId || q.committed[id] {
+		return nil
+	}
+	return q.remove([]int64{id})
+}
+
+// Remove items by ids out of order in one write. See Commit
+func (q *Queue) CommitBatch(ids []int64) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	var pending []int64
+	for _, id := range ids {
+		if id < q.readId || id >= q.writeId || q.committed[id] {
+			continue
+		}
+		pending = append(pending, id)
+	}
+	return q.remove(pending)
+}
+
+// Move read pointer back to the id for replay of consumed items. Id should be between FirstId and WriteId.
+// Works only if read pointer is persisted
+func (q *Queue) Rewind(id int64) error {
+	q.lock.Lock()
+	if !q.durable {
+		q.lock.Unlock()
+		return errors.New("rewind is supported only for persisted cursor")
+	}
+	if id < q.firstId || id > q.writeId {
+		q.lock.Unlock()
+		return ErrNotFound
+	}
+	err := q.storage.Put(q.cursorKey(), encodeInt(id))
 	if err != nil {
+		q.lock.Unlock()
 		return err
 	}
-
-	q.readId++
+	q.readId = id
+	q.committed = make(map[int64]bool)
+	q.lock.Unlock()
+	q.onCreated.notify()
 	return nil
 }
 
-func NewMapQueue(storage storages.Storage) (*Queue, error) {
-	var minVal int64 = math.MaxInt64
-	var maxVal int64 = math.MinInt64
-	var empty = true
-	err := storage.Keys(func(key []byte) error {
-		id, err := strconv.ParseInt(string(key), 10, 64)
-		if err != nil {
-			return err
+// ids of up to N not committed items from head. Should be called under lock
+func (q *Queue) pending(n int) []int64 {
+	var ids []int64
+	for id := q.readId; id < q.writeId && len(ids) < n; id++ {
+		if !q.committed[id] {
+			ids = append(ids, id)
 		}
-		if id < minVal {
-			minVal = id
+	}
+	return ids
+}
+
+// mark pending items as removed, move read pointer over contiguous prefix of removed items and clean storage
+// according to mode. Should be called under write lock
+func (q *Queue) remove(ids []int64) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	for _, id := range ids {
+		q.committed[id] = true
+	}
+	readId := q.readId
+	for q.committed[readId] {
+		readId++
+	}
+	firstId := q.firstId
+	batch := &Batch{}
+	var deleted []int64
+	if !q.durable {
+		for _, id := range ids {
+			q.delItem(batch, id)
 		}
-		if id > maxVal {
-			maxVal = id
+		deleted = ids
+		firstId = readId
+	} else if readId != q.readId {
+		batch.Put(q.cursorKey(), encodeInt(readId))
+		minReadId := q.minReadId(q, readId)
+		for ; q.keepConsumed >= 0 && firstId < minReadId-q.keepConsumed; firstId++ {
+			q.delItem(batch, firstId)
 		}
-		empty = false
-		return nil
-	})
+	}
+	saveLayout := q.driftLayout(batch, firstId, q.writeId)
+	err := writeBatch(q.storage, batch)
 	if err != nil {
-		return nil, err
+		for _, id := range ids {
+			delete(q.committed, id)
+		}
+		return err
+	}
+	if saveLayout {
+		q.layoutFirst, q.layoutNext = firstId, q.writeId
 	}
-	if empty {
-		minVal = 0
-		maxVal = 0
-	} else {
-		maxVal++ // point to next cell for writing
+	for ; q.readId < readId; q.readId++ {
+		delete(q.committed, q.readId)
 	}
-	return &Queue{storage: storage, writeId: maxVal, readId: minVal}, nil
+	q.firstId = firstId
+	q.dequeued += int64(len(ids))
+	q.dequeueRate.add(int64(len(ids)), time.Now())
+	q.forget(deleted)
+	return nil
 }
+
+// Open queue over storage with default configuration
+func NewMapQueue(storage storages.Storage) (*Queue, error) { return New(storage).Open() }
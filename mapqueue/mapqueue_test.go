@@ -0,0 +1,114 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"testing"
+)
+
+func TestQueue_holeInTheMiddle(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Del(itemKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "c"} {
+		data, err := queue.HeadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data != expected {
+			t.Fatalf("expected %v, got %v", expected, data)
+		}
+		if err := queue.RemoveN(1); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !queue.Empty() {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestQueue_headIdsOverHole(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Del(itemKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	ids, items, err := queue.HeadIds(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ids) != 2 || ids[0] != 0 || ids[1] != 2 || string(items[0]) != "a" || string(items[1]) != "c" {
+		t.Fatal("unexpected head", ids, items)
+	}
+	if err := queue.CommitBatch(ids); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Empty() {
+		t.Fatal("queue should be empty")
+	}
+}
+
+func TestQueue_holeAtTheTail(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Del(itemKey(1)); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.RemoveN(1); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := queue.Head(); err != ErrEmpty {
+		t.Fatal("expected empty queue after skipping missing item, got", err)
+	}
+	if !queue.Empty() {
+		t.Fatal("queue should be empty")
+	}
+	if err := queue.PutString("c"); err != nil {
+		t.Fatal(err)
+	}
+	data, err := queue.HeadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "c" {
+		t.Fatal("expected c, got", data)
+	}
+}
+
+func TestQueue_statsSizeAfterCommit(t *testing.T) {
+	queue, err := NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Commit(queue.ReadId() + 1); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Size() != 2 {
+		t.Fatal("expected size 2, got", queue.Size())
+	}
+	if stats := queue.Stats(); stats.Size != queue.Size() {
+		t.Fatal("stats size", stats.Size, "differs from queue size", queue.Size())
+	}
+}
@@ -4,20 +4,22 @@ import "sync"
 
 // Subscription of queue events
 type Subscription struct {
-	ch     chan struct{}
-	bucket *Notification
+	ch      chan struct{}
+	buckets []*Notification
 }
 
 // Unsubscribe from queue and close notification channel
 func (sb *Subscription) Close() {
-	sb.bucket.lock.Lock()
-	for i, s := range sb.bucket.channels {
-		if s == sb.ch {
-			sb.bucket.channels = append(sb.bucket.channels[:i], sb.bucket.channels[i+1:]...)
-			break
+	for _, bucket := range sb.buckets {
+		bucket.lock.Lock()
+		for i, s := range bucket.channels {
+			if s == sb.ch {
+				bucket.channels = append(bucket.channels[:i], bucket.channels[i+1:]...)
+				break
+			}
 		}
+		bucket.lock.Unlock()
 	}
-	sb.bucket.lock.Unlock()
 	close(sb.ch)
 }
 
@@ -31,17 +33,25 @@ type Notification struct {
 }
 
 // Create new subscription for events
-func (not *Notification) Subscribe() *Subscription {
-	not.lock.Lock()
-	defer not.lock.Unlock()
+func (not *Notification) Subscribe() *Subscription { return subscribe(not) }
+
+// single subscription for events of any of notifications
+func subscribe(nots ...*Notification) *Subscription {
 	ch := make(chan struct{}, 1)
-	not.channels = append(not.channels, ch)
+	for _, not := range nots {
+		not.lock.Lock()
+		not.channels = append(not.channels, ch)
+		not.lock.Unlock()
+	}
 	return &Subscription{
-		bucket: not,
-		ch:     ch,
+		buckets: nots,
+		ch:      ch,
 	}
 }
 
+// Notify all subscribers. Never blocks: subscriber that did not handle previous event gets only one
+func (not *Notification) Notify() { not.notify() }
+
 func (not *Notification) notify() {
 	not.lock.RLock()
 	defer not.lock.RUnlock()
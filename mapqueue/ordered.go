@@ -0,0 +1,41 @@
+package mapqueue
+
+import (
+	"github.com/pkg/errors"
+	"github.com/reddec/storages"
+)
+
+// Optional extension of storage with keys sorted in byte order (like leveldb). Lets queue find first and last
+// items without scanning all keys
+type OrderedStorage interface {
+	// Iterate over keys with prefix in ascending (or descending if reverse) byte order till handler returns error
+	Range(prefix []byte, reverse bool, handler func(key []byte) error) error
+}
+
+var errStopIteration = errors.New("stop iteration")
+
+// first (or last if reverse) key with prefix or nil
+func edgeKey(storage OrderedStorage, prefix []byte, reverse bool) ([]byte, error) {
+	var found []byte
+	err := storage.Range(prefix, reverse, func(key []byte) error {
+		found = append([]byte(nil), key...)
+		return errStopIteration
+	})
+	if err != nil && err != errStopIteration {
+		return nil, err
+	}
+	return found, nil
+}
+
+// iterate over keys with prefix. Uses ordered iteration if supported
+func prefixKeys(storage storages.Storage, prefix []byte, handler func(key []byte) error) error {
+	if ordered, ok := storage.(OrderedStorage); ok {
+		return ordered.Range(prefix, false, handler)
+	}
+	return storage.Keys(func(key []byte) error {
+		if len(key) < len(prefix) || string(key[:len(prefix)]) != string(prefix) {
+			return nil
+		}
+		return handler(key)
+	})
+}
@@ -0,0 +1,67 @@
+package mapqueue
+
+import (
+	"bytes"
+	"github.com/pkg/errors"
+	"github.com/reddec/storages"
+)
+
+// view of part of storage with keys under prefix. Extensions of underlying storage are kept
+type prefixStorage struct {
+	storage storages.Storage
+	prefix  []byte
+}
+
+// ordered view of part of storage (for storages with OrderedStorage extension)
+type orderedPrefixStorage struct {
+	*prefixStorage
+	ordered OrderedStorage
+}
+
+func prefixed(storage storages.Storage, prefix string) storages.Storage {
+	view := &prefixStorage{storage: storage, prefix: []byte(prefix)}
+	if ordered, ok := storage.(OrderedStorage); ok {
+		return &orderedPrefixStorage{prefixStorage: view, ordered: ordered}
+	}
+	return view
+}
+
+func (ps *prefixStorage) key(key []byte) []byte {
+	return append(append(make([]byte, 0, len(ps.prefix)+len(key)), ps.prefix...), key...)
+}
+
+func (ps *prefixStorage) Put(key []byte, data []byte) error { return ps.storage.Put(ps.key(key), data) }
+
+func (ps *prefixStorage) Get(key []byte) ([]byte, error) { return ps.storage.Get(ps.key(key)) }
+
+func (ps *prefixStorage) Del(key []byte) error { return ps.storage.Del(ps.key(key)) }
+
+func (ps *prefixStorage) Keys(handler func(key []byte) error) error {
+	return prefixKeys(ps.storage, ps.prefix, func(key []byte) error {
+		return handler(key[len(ps.prefix):])
+	})
+}
+
+// Underlying storage is shared and should be closed by owner
+func (ps *prefixStorage) Close() error { return nil }
+
+func (ps *prefixStorage) WriteBatch(batch *Batch) error {
+	prefixedBatch := &Batch{}
+	for _, op := range batch.ops {
+		prefixedBatch.ops = append(prefixedBatch.ops, batchOp{key: ps.key(op.key), data: op.data, del: op.del})
+	}
+	return writeBatch(ps.storage, prefixedBatch)
+}
+
+func (ps *prefixStorage) Sync() error {
+	if syncStorage, ok := ps.storage.(SyncStorage); ok {
+		return syncStorage.Sync()
+	}
+	return errors.New("storage does not support sync")
+}
+
+func (ops *orderedPrefixStorage) Range(prefix []byte, reverse bool, handler func(key []byte) error) error {
+	return ops.ordered.Range(ops.key(prefix), reverse, func(key []byte) error {
+		return handler(bytes.TrimPrefix(key, ops.prefix))
+	})
+}
@@ -0,0 +1,153 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/pkg/errors"
+	"strconv"
+	"sync"
+)
+
+// lane of level N keeps own items and pointers under "<meta>/priority/N/", so priority queue may share storage with
+// regular queue
+const priorityPrefix = metaPrefix + "priority/"
+
+// Queue with fixed set of priority levels (lanes). Level 0 is the highest priority. Each lane is a regular queue
+// over the same storage with prefixed keys.
+//
+// By default lanes are drained strictly highest-priority-first, so lower lanes may starve. With weights (see
+// QueueConfig.Weights) non-empty lanes are chosen by smooth weighted round-robin.
+type PriorityQueue struct {
+	lanes   []*Queue
+	weights []int
+	lock    sync.Mutex
+	credits []int
+}
+
+// Weights of priority lanes for fair draining of priority queue (see OpenPriority). Number of weights should be
+// equal to number of levels, each weight should be positive. Ignored for regular queue
+func (qc *QueueConfig) Weights(weights ...int) *QueueConfig {
+	qc.weights = weights
+	return qc
+}
+
+// Open priority queue with defined number of levels. All options (limits, durability and etc) are applied to each
+// lane separately
+func (qc *QueueConfig) OpenPriority(levels int) (*PriorityQueue, error) {
+	if levels <= 0 {
+		return nil, errors.New("number of priority levels should be positive")
+	}
+	if qc.weights != nil {
+		if len(qc.weights) != levels {
+			return nil, errors.Errorf("%v weights defined for %v priority levels", len(qc.weights), levels)
+		}
+		for _, w := range qc.weights {
+			if w <= 0 {
+				return nil, errors.New("weights of priority levels should be positive")
+			}
+		}
+	}
+	if err := checkDurability(qc.storage, qc.durability); err != nil {
+		return nil, err
+	}
+	pq := &PriorityQueue{weights: qc.weights, credits: make([]int, levels)}
+	for level := 0; level < levels; level++ {
+		cfg := *qc
+		cfg.storage = prefixed(qc.storage, priorityPrefix+strconv.Itoa(level)+"/")
+		lane, err := cfg.Open()
+		if err != nil {
+			return nil, errors.Wrapf(err, "open priority level %v", level)
+		}
+		pq.lanes = append(pq.lanes, lane)
+	}
+	return pq, nil
+}
+
+// Number of priority levels
+func (pq *PriorityQueue) Levels() int { return len(pq.lanes) }
+
+// Queue of priority level
+func (pq *PriorityQueue) Lane(level int) *Queue { return pq.lanes[level] }
+
+// Put item to the tail of lane with defined priority level
+func (pq *PriorityQueue) Put(level int, data []byte) error {
+	return pq.PutContext(context.Background(), level, data)
+}
+
+// Put item to the tail of lane with defined priority level. See Queue.PutContext
+func (pq *PriorityQueue) PutContext(ctx context.Context, level int, data []byte) error {
+	if level < 0 || level >= len(pq.lanes) {
+		return errors.Errorf("unknown priority level %v", level)
+	}
+	return pq.lanes[level].PutContext(ctx, data)
+}
+
+// Total number of items in all lanes
+func (pq *PriorityQueue) Size() int64 {
+	var size int64
+	for _, lane := range pq.lanes {
+		size += lane.Size()
+	}
+	return size
+}
+
+// Close all lanes. See Queue.Close
+func (pq *PriorityQueue) Close() error {
+	var lastErr error
+	for _, lane := range pq.lanes {
+		if err := lane.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Check that all lanes are empty
+func (pq *PriorityQueue) Empty() bool {
+	for _, lane := range pq.lanes {
+		if !lane.Empty() {
+			return false
+		}
+	}
+	return true
+}
+
+// Subscribe for new items in any lane
+func (pq *PriorityQueue) Subscribe() *Subscription {
+	var nots []*Notification
+	for _, lane := range pq.lanes {
+		nots = append(nots, lane.OnCreated())
+	}
+	return subscribe(nots...)
+}
+
+// Lane that should be read next or nil if all lanes are empty. Each call is counted as one turn of lane in weighted
+// round-robin, so it should be called once per read
+func (pq *PriorityQueue) Next() *Queue {
+	if pq.weights == nil {
+		for _, lane := range pq.lanes {
+			if !lane.Empty() {
+				return lane
+			}
+		}
+		return nil
+	}
+	pq.lock.Lock()
+	defer pq.lock.Unlock()
+	var total int
+	var best = -1
+	for i, lane := range pq.lanes {
+		if lane.Empty() {
+			continue
+		}
+		pq.credits[i] += pq.weights[i]
+		total += pq.weights[i]
+		if best < 0 || pq.credits[i] > pq.credits[best] {
+			best = i
+		}
+	}
+	if best < 0 {
+		return nil
+	}
+	pq.credits[best] -= total
+	return pq.lanes[best]
+}
@@ -0,0 +1,127 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"strconv"
+	"testing"
+)
+
+// read and remove head of lanes till priority queue is empty. Returns levels of read items
+func drainLevels(t *testing.T, pq *PriorityQueue) []int {
+	var levels []int
+	for lane := pq.Next(); lane != nil; lane = pq.Next() {
+		data, err := lane.HeadString()
+		if err != nil {
+			t.Fatal(err)
+		}
+		level, err := strconv.Atoi(data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := lane.Remove(); err != nil {
+			t.Fatal(err)
+		}
+		levels = append(levels, level)
+	}
+	return levels
+}
+
+// put defined number of items to each level, item data is level number
+func fillLevels(t *testing.T, pq *PriorityQueue, counts ...int) {
+	for level, n := range counts {
+		for i := 0; i < n; i++ {
+			if err := pq.Put(level, []byte(strconv.Itoa(level))); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestPriorityQueue_strict(t *testing.T) {
+	pq, err := New(memstorage.New()).OpenPriority(3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillLevels(t, pq, 2, 2, 2)
+	levels := drainLevels(t, pq)
+	for i, expected := range []int{0, 0, 1, 1, 2, 2} {
+		if levels[i] != expected {
+			t.Fatal("lanes are not drained highest first:", levels)
+		}
+	}
+	if err := pq.Put(3, []byte("unknown")); err == nil {
+		t.Fatal("put to unknown level should fail")
+	}
+}
+
+func TestPriorityQueue_weights(t *testing.T) {
+	pq, err := New(memstorage.New()).Weights(3, 1).OpenPriority(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillLevels(t, pq, 30, 10)
+	levels := drainLevels(t, pq)
+	if len(levels) != 40 {
+		t.Fatal("expected 40 items, got", len(levels))
+	}
+	// each 4 reads contain 3 items of level 0 and 1 item of level 1
+	for turn := 0; turn < len(levels); turn += 4 {
+		var high int
+		for _, level := range levels[turn : turn+4] {
+			if level == 0 {
+				high++
+			}
+		}
+		if high != 3 {
+			t.Fatalf("reads %v-%v: expected 3 items of level 0, got %v (%v)", turn, turn+3, high, levels[turn:turn+4])
+		}
+	}
+	// the only non-empty lane is read regardless of weight
+	fillLevels(t, pq, 0, 3)
+	if levels := drainLevels(t, pq); len(levels) != 3 {
+		t.Fatal("expected 3 items of level 1, got", levels)
+	}
+}
+
+func TestOpenPriority_invalidWeights(t *testing.T) {
+	if _, err := New(memstorage.New()).OpenPriority(0); err == nil {
+		t.Fatal("zero levels should be rejected")
+	}
+	if _, err := New(memstorage.New()).Weights(1).OpenPriority(2); err == nil {
+		t.Fatal("number of weights should match levels")
+	}
+	if _, err := New(memstorage.New()).Weights(1, 0).OpenPriority(2); err == nil {
+		t.Fatal("non-positive weight should be rejected")
+	}
+}
+
+func TestOpenPriority_sharedStorage(t *testing.T) {
+	storage := memstorage.New()
+	pq, err := New(storage).OpenPriority(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fillLevels(t, pq, 1, 1)
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("regular"); err != nil {
+		t.Fatal(err)
+	}
+	report, err := Check(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() || report.Items != 1 {
+		t.Fatalf("only item of regular queue should be reported: %+v", report)
+	}
+	// lanes are restored without items of regular queue
+	pq, err = New(storage).OpenPriority(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pq.Size() != 2 {
+		t.Fatal("expected 2 items in lanes, got", pq.Size())
+	}
+}
@@ -0,0 +1,181 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages"
+	"os"
+	"sort"
+	"strings"
+)
+
+// prefix of records moved aside by Repair
+const quarantinePrefix = metaPrefix + "quarantine/"
+
+// Range of missing items [From, To)
+type Gap struct {
+	From int64
+	To   int64
+}
+
+// Result of storage scan
+type Report struct {
+	First       int64    // id of first item
+	Next        int64    // id of next item for writing
+	Items       int64    // number of readable items
+	Gaps        []Gap    // missing items in the middle of queue
+	Foreign     []string // keys that are neither items nor queue metadata
+	Unreadable  []int64  // items which value could not be read or decoded
+	BadCursors  []string // read pointers keys with invalid or out of range value
+	Orphans     []string // meta records of missing items
+	Quarantined int      // number of records moved to quarantine by Repair
+}
+
+// Check that storage is consistent
+func (r *Report) Ok() bool {
+	return len(r.Gaps) == 0 && len(r.Foreign) == 0 && len(r.Unreadable) == 0 && len(r.BadCursors) == 0 &&
+		len(r.Orphans) == 0
+}
+
+// Scan storage and report problems without modification. Encrypted items are not verified, because keys are not
+// known (see QueueConfig.Check). Queue should not be opened during scan
+func Check(storage storages.Storage) (*Report, error) { return New(storage).Check() }
+
+// Scan storage and fix problems so the queue can be opened again: foreign keys and unreadable items are moved to
+// quarantine (under reserved meta keys), invalid read pointers are reset to the nearest valid value, meta records
+// of missing items are removed, persisted layout is dropped. Gaps are reported but kept. Queue should not be opened during repair
+func Repair(storage storages.Storage) (*Report, error) { return New(storage).Repair() }
+
+// Check storage (see Check). Items are decoded as by queue opened with this configuration
+func (qc *QueueConfig) Check() (*Report, error) { return qc.scan(false) }
+
+// Repair storage (see Repair). Items which could not be decoded as by queue opened with this configuration are
+// moved to quarantine
+func (qc *QueueConfig) Repair() (*Report, error) { return qc.scan(true) }
+
+func (qc *QueueConfig) scan(repair bool) (*Report, error) {
+	storage := qc.storage
+	j := &journal{
+		storage:    storage,
+		encryption: qc.encryption,
+		namespace:  qc.encryptionNamespace(),
+		plaintext:  qc.readPlaintext,
+	}
+	format, err := storage.Get(formatKey)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	migrated := err == nil && string(format) == binaryFormat
+	var ids []int64
+	var keys = make(map[int64][]byte) // item id -> key (binary or legacy)
+	var foreign, cursors, times []string
+	err = storage.Keys(func(key []byte) error {
+		name := string(key)
+		switch {
+		case name == string(cursorKey) || strings.HasPrefix(name, consumerPrefix):
+			cursors = append(cursors, name)
+		case strings.HasPrefix(name, timePrefix):
+			times = append(times, name)
+		case isMetaKey(key):
+		default:
+			id, ok := parseItemKey(key)
+			if !ok {
+				id, ok = parseLegacyItemKey(key)
+			}
+			if !ok {
+				foreign = append(foreign, name)
+			} else {
+				ids = append(ids, id)
+				keys[id] = append([]byte(nil), key...)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	sort.Strings(foreign)
+	report := &Report{Foreign: foreign}
+	batch := &Batch{}
+	quarantine := func(key []byte, data []byte) {
+		batch.Put(append([]byte(quarantinePrefix), key...), data)
+		batch.Del(key)
+		report.Quarantined++
+	}
+	for _, key := range foreign {
+		data, err := storage.Get([]byte(key))
+		if err != nil && !os.IsNotExist(err) {
+			data = nil
+		}
+		quarantine([]byte(key), data)
+	}
+	var existent = make(map[int64]bool, len(ids))
+	for i, id := range ids {
+		if i > 0 && id > ids[i-1]+1 {
+			report.Gaps = append(report.Gaps, Gap{From: ids[i-1] + 1, To: id})
+		}
+		data, err := storage.Get(keys[id])
+		if err == nil && (j.encryption != nil || !isEncrypted(data)) {
+			_, err = j.decodeEnvelope(id, data)
+		}
+		if err != nil {
+			report.Unreadable = append(report.Unreadable, id)
+			quarantine(keys[id], data)
+			continue
+		}
+		existent[id] = true
+		report.Items++
+	}
+	// bounds by readable items
+	for _, id := range ids {
+		if existent[id] {
+			report.First = id
+			break
+		}
+	}
+	for i := len(ids) - 1; i >= 0; i-- {
+		if existent[ids[i]] {
+			report.Next = ids[i] + 1
+			break
+		}
+	}
+	if report.Items == 0 {
+		report.First, report.Next = 0, 0
+	}
+	for _, key := range cursors {
+		value, err := storage.Get([]byte(key))
+		if err != nil {
+			report.BadCursors = append(report.BadCursors, key)
+			batch.Put([]byte(key), encodeInt(report.First))
+			continue
+		}
+		readId, err := decodeInt(value)
+		if err != nil || readId > report.Next {
+			report.BadCursors = append(report.BadCursors, key)
+			batch.Put([]byte(key), encodeInt(report.First))
+		}
+	}
+	for _, key := range times {
+		var id int64
+		var ok bool
+		if !migrated {
+			id, ok = parseLegacyTimeKey([]byte(key))
+		}
+		if !ok {
+			id, ok = parseId([]byte(key), timePrefix)
+		}
+		if !ok || !existent[id] {
+			report.Orphans = append(report.Orphans, key)
+			batch.Del([]byte(key))
+		}
+	}
+	if repair {
+		// layout will be rebuilt on next open
+		batch.Del(layoutKey)
+		if err := writeBatch(storage, batch); err != nil {
+			return report, err
+		}
+	} else {
+		report.Quarantined = 0
+	}
+	return report, nil
+}
@@ -0,0 +1,192 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"reflect"
+	"testing"
+)
+
+func TestCheckAndRepair(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"a", "b", "c", "d"} {
+		if err := queue.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// damage storage: hole in the middle, foreign key, broken cursor and orphan meta record
+	for _, err := range []error{
+		storage.Del(itemKey(1)),
+		storage.Put([]byte("foreign"), []byte("value")),
+		storage.Put(cursorKey, []byte("100")),
+		storage.Put(timeKey(42), encodeInt(0)),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	report, err := Check(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Ok() {
+		t.Fatal("damaged storage reported as ok")
+	}
+	expected := &Report{
+		Next:       4,
+		Items:      3,
+		Gaps:       []Gap{{From: 1, To: 2}},
+		Foreign:    []string{"foreign"},
+		BadCursors: []string{string(cursorKey)},
+		Orphans:    []string{string(timeKey(42))},
+	}
+	if !reflect.DeepEqual(report, expected) {
+		t.Fatalf("unexpected report: %+v", report)
+	}
+	if _, err := storage.Get([]byte("foreign")); err != nil {
+		t.Fatal("check should not modify storage:", err)
+	}
+
+	report, err = Repair(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Quarantined != 1 {
+		t.Fatal("expected one quarantined record, got", report.Quarantined)
+	}
+	if _, err := storage.Get([]byte("foreign")); err == nil {
+		t.Fatal("foreign key should be moved to quarantine")
+	}
+	data, err := storage.Get([]byte(quarantinePrefix + "foreign"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "value" {
+		t.Fatal("quarantined value changed:", string(data))
+	}
+
+	report, err = Check(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Foreign) != 0 || len(report.BadCursors) != 0 || len(report.Orphans) != 0 {
+		t.Fatalf("problems left after repair: %+v", report)
+	}
+	if len(report.Gaps) != 1 {
+		t.Fatal("gaps should be kept by repair:", report.Gaps)
+	}
+
+	queue, err = New(storage).PersistCursor().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for id, expected := range map[int64]string{0: "a", 2: "c", 3: "d"} {
+		data, err := queue.Get(id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %v, got %v", expected, string(data))
+		}
+	}
+	if size := queue.Size(); size != 4 {
+		t.Fatal("read pointer should be kept by repair, size", size)
+	}
+}
+
+func TestCheckAndRepair_brokenEnvelope(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := New(storage).Envelope().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"a", "b", "c"} {
+		if err := queue.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// header length is bigger than record
+	broken := append(append([]byte(nil), envelopeMagic...), 100, '{')
+	if err := storage.Put(itemKey(1), broken); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Check(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Ok() || !reflect.DeepEqual(report.Unreadable, []int64{1}) {
+		t.Fatalf("broken item is not reported: %+v", report)
+	}
+
+	report, err = Repair(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Quarantined != 1 {
+		t.Fatal("expected one quarantined record, got", report.Quarantined)
+	}
+	data, err := storage.Get(append([]byte(quarantinePrefix), itemKey(1)...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != string(broken) {
+		t.Fatal("quarantined record changed")
+	}
+
+	queue, err = NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, expected := range []string{"a", "c"} {
+		data, err := queue.Pop(context.Background())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("expected %v, got %v", expected, string(data))
+		}
+	}
+}
+
+func TestCheck_encryptedItems(t *testing.T) {
+	storage := memstorage.New()
+	config := func() *QueueConfig { return New(storage).Encrypt(AESGCM, testKeys("k1")) }
+	queue, err := config().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	// record of other id could not be decrypted
+	record, err := storage.Get(itemKey(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := storage.Put(itemKey(0), record); err != nil {
+		t.Fatal(err)
+	}
+
+	// without keys encrypted items are not verified
+	report, err := Check(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !report.Ok() {
+		t.Fatalf("encrypted items reported without keys: %+v", report)
+	}
+
+	report, err = config().Check()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(report.Unreadable, []int64{0}) {
+		t.Fatalf("broken encrypted item is not reported: %+v", report)
+	}
+}
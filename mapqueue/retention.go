@@ -0,0 +1,305 @@
+package mapqueue
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+)
+
+// Behaviour of Put when queue limits are reached
+type OverflowPolicy int
+
+const (
+	// Drop oldest items (even not consumed) to free space for new one
+	DropOldest OverflowPolicy = 0
+	// Reject new items with FullError
+	Reject OverflowPolicy = 1
+	// Block producer till items will be removed
+	Block OverflowPolicy = 2
+)
+
+// Error returned by Put if queue limits are reached and overflow policy is Reject
+type FullError struct {
+	Items int64 // number of items in queue
+	Bytes int64 // total size of items in queue
+}
+
+func (fe *FullError) Error() string {
+	return fmt.Sprintf("queue is full (%v items, %v bytes)", fe.Items, fe.Bytes)
+}
+
+// Check that error caused by reached limits of queue
+func IsFull(err error) bool {
+	_, ok := err.(*FullError)
+	return ok
+}
+
+type limits struct {
+	maxItems int64
+	maxBytes int64
+	maxAge   time.Duration
+	overflow OverflowPolicy
+}
+
+func (l limits) enabled() bool { return l.maxItems > 0 || l.maxBytes > 0 || l.maxAge > 0 }
+
+// index of sizes and enqueue times of items in storage. Used only if limits are defined
+type itemIndex struct {
+	first int64   // id of first item in index
+	sizes []int64 // size of each item, -1 for removed
+	times []int64 // enqueue time in unix nanoseconds
+	count int64   // number of items in storage
+	bytes int64   // total size of items in storage
+}
+
+func (ix *itemIndex) add(size int64, enqueued time.Time) {
+	ix.sizes = append(ix.sizes, size)
+	ix.times = append(ix.times, enqueued.UnixNano())
+	ix.count++
+	ix.bytes += size
+}
+
+// mark item as removed
+func (ix *itemIndex) del(id int64) {
+	i := id - ix.first
+	if i < 0 || i >= int64(len(ix.sizes)) || ix.sizes[i] < 0 {
+		return
+	}
+	ix.count--
+	ix.bytes -= ix.sizes[i]
+	ix.sizes[i] = -1
+}
+
+// remove all items before id
+func (ix *itemIndex) trim(id int64) {
+	for ; ix.first < id && len(ix.sizes) > 0; ix.first++ {
+		ix.del(ix.first)
+		ix.sizes = ix.sizes[1:]
+		ix.times = ix.times[1:]
+	}
+	if len(ix.sizes) == 0 {
+		ix.first = id
+	}
+}
+
+func (ix *itemIndex) removed(id int64) bool {
+	i := id - ix.first
+	return i < 0 || i >= int64(len(ix.sizes)) || ix.sizes[i] < 0
+}
+
+func (ix *itemIndex) size(id int64) int64 { return ix.sizes[id-ix.first] }
+
+func (ix *itemIndex) enqueued(id int64) int64 { return ix.times[id-ix.first] }
+
+// build index of items in storage. Should be called only once while opening
+func (j *journal) buildIndex() error {
+	ix := &itemIndex{first: j.firstId}
+	now := time.Now()
+	for id := j.firstId; id < j.writeId; id++ {
+		data, err := j.storage.Get(itemKey(id))
+		if os.IsNotExist(err) {
+			ix.add(0, now)
+			ix.del(id)
+			continue
+		} else if err != nil {
+			return err
+		}
+		enqueued := now
+		if j.limits.maxAge > 0 {
+			if value, err := j.storage.Get(timeKey(id)); err == nil {
+				if nano, err := decodeInt(value); err == nil {
+					enqueued = time.Unix(0, nano)
+				}
+			}
+		}
+		ix.add(int64(len(data)), enqueued)
+	}
+	j.index = ix
+	return nil
+}
+
+// add deletion of item and related meta information to batch
+func (j *journal) delItem(batch *Batch, id int64) {
+	batch.Del(itemKey(id))
+	if j.limits.maxAge > 0 {
+		batch.Del(timeKey(id))
+	}
+}
+
+// update index and notify subscribers (including blocked producers) after removing items.
+// Should be called under write lock
+func (j *journal) forget(ids []int64) {
+	if j.index != nil {
+		for _, id := range ids {
+			j.index.del(id)
+		}
+		j.index.trim(j.firstId)
+	}
+	j.onRemoved.notify()
+}
+
+// ensure that count items with total size could be added according to limits. Should be called under write lock.
+// Lock is released while waiting for free space
+func (j *journal) reserve(ctx context.Context, count int64, size int64) error {
+	if j.index == nil {
+		return nil
+	}
+	for {
+		if err := j.expire(); err != nil {
+			return err
+		}
+		if j.fits(count, size) {
+			return nil
+		}
+		// consumed but kept items are dropped first
+		if minReadId := j.minReadId(nil, 0); j.firstId < minReadId {
+			if err := j.trim(minReadId); err != nil {
+				return err
+			}
+			continue
+		}
+		switch j.limits.overflow {
+		case Reject:
+			return &FullError{Items: j.index.count, Bytes: j.index.bytes}
+		case Block:
+			if ctx.Value(noWaitKey{}) != nil {
+				return &FullError{Items: j.index.count, Bytes: j.index.bytes}
+			}
+			if err := j.waitRemoved(ctx); err != nil {
+				return err
+			}
+		default:
+			if err := j.trim(j.oldestToFit(count, size)); err != nil {
+				return err
+			}
+			return nil
+		}
+	}
+}
+
+type noWaitKey struct{}
+
+// context of put which should not wait for free space: Block policy acts as Reject
+func withoutWait(ctx context.Context) context.Context {
+	return context.WithValue(ctx, noWaitKey{}, true)
+}
+
+// wait for removing of any item or context cancellation. Should be called under write lock
+func (j *journal) waitRemoved(ctx context.Context) error {
+	sub := j.onRemoved.Subscribe()
+	defer sub.Close()
+	j.lock.Unlock()
+	defer j.lock.Lock()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-sub.Wait():
+		return nil
+	}
+}
+
+// check that items could be added without breaking limits. Empty queue accepts anything
+func (j *journal) fits(count int64, size int64) bool {
+	if j.index.count == 0 {
+		return true
+	}
+	if j.limits.maxItems > 0 && j.index.count+count > j.limits.maxItems {
+		return false
+	}
+	if j.limits.maxBytes > 0 && j.index.bytes+size > j.limits.maxBytes {
+		return false
+	}
+	return true
+}
+
+// id of first item that should be kept to fit new items
+func (j *journal) oldestToFit(count int64, size int64) int64 {
+	items, bytes := j.index.count, j.index.bytes
+	id := j.firstId
+	for ; id < j.writeId; id++ {
+		if items == 0 ||
+			(j.limits.maxItems <= 0 || items+count <= j.limits.maxItems) &&
+				(j.limits.maxBytes <= 0 || bytes+size <= j.limits.maxBytes) {
+			break
+		}
+		if !j.index.removed(id) {
+			items--
+			bytes -= j.index.size(id)
+		}
+	}
+	return id
+}
+
+// drop expired items. Should be called under write lock
+func (j *journal) expire() error {
+	if j.index == nil || j.limits.maxAge <= 0 {
+		return nil
+	}
+	deadline := time.Now().Add(-j.limits.maxAge).UnixNano()
+	id := j.firstId
+	for id < j.writeId && (j.index.removed(id) || j.index.enqueued(id) < deadline) {
+		id++
+	}
+	return j.trim(id)
+}
+
+// drop expired items under lock
+func (j *journal) expireLocked() error {
+	if j.limits.maxAge <= 0 {
+		return nil
+	}
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	return j.expire()
+}
+
+// drop all items before id regardless of consumers. Read pointers behind the id are moved forward.
+// Should be called under write lock
+func (j *journal) trim(firstId int64) error {
+	if firstId <= j.firstId {
+		return nil
+	}
+	batch := &Batch{}
+	for id := j.firstId; id < firstId; id++ {
+		j.delItem(batch, id)
+	}
+	var moved = make(map[*Queue]int64)
+	for _, consumer := range j.consumers {
+		if consumer.readId >= firstId {
+			continue
+		}
+		readId := firstId
+		for consumer.committed[readId] {
+			readId++
+		}
+		moved[consumer] = readId
+		if j.durable {
+			batch.Put(consumer.cursorKey(), encodeInt(readId))
+		}
+	}
+	newFirstId := firstId
+	if readId, ok := moved[j.consumers[""]]; ok && !j.durable {
+		// in non-persistent mode storage starts from read pointer
+		newFirstId = readId
+	}
+	saveLayout := j.driftLayout(batch, newFirstId, j.writeId)
+	err := writeBatch(j.storage, batch)
+	if err != nil {
+		return err
+	}
+	if saveLayout {
+		j.layoutFirst, j.layoutNext = newFirstId, j.writeId
+	}
+	for consumer, readId := range moved {
+		for id := range consumer.committed {
+			if id < readId {
+				delete(consumer.committed, id)
+			}
+		}
+		consumer.readId = readId
+	}
+	j.firstId = newFirstId
+	j.forget(nil)
+	return nil
+}
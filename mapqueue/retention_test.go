@@ -0,0 +1,73 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"testing"
+	"time"
+)
+
+// open queue for one item which blocks on overflow and fill it
+func fullBlockingQueue(t *testing.T) *Queue {
+	queue, err := New(memstorage.New()).Limit(1, 0, 0).Overflow(Block).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("a"); err != nil {
+		t.Fatal(err)
+	}
+	return queue
+}
+
+// run put in background and check that it is blocked
+func blockedPut(t *testing.T, put func() error) <-chan error {
+	done := make(chan error, 1)
+	go func() { done <- put() }()
+	select {
+	case err := <-done:
+		t.Fatal("put is not blocked by full queue:", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return done
+}
+
+func TestQueue_PutContextBlocksTillRemove(t *testing.T) {
+	queue := fullBlockingQueue(t)
+	done := blockedPut(t, func() error { return queue.PutContext(context.Background(), []byte("b")) })
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("put is not released after remove")
+	}
+	data, err := queue.HeadString()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data != "b" {
+		t.Fatal("expected b, got", data)
+	}
+}
+
+func TestQueue_PutContextCancel(t *testing.T) {
+	queue := fullBlockingQueue(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := blockedPut(t, func() error { return queue.PutContext(ctx, []byte("b")) })
+	cancel()
+	select {
+	case err := <-done:
+		if err != context.Canceled {
+			t.Fatal("expected cancellation, got", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("put is not released after cancel")
+	}
+	if queue.Size() != 1 {
+		t.Fatal("cancelled item is put, size", queue.Size())
+	}
+}
@@ -0,0 +1,290 @@
+package mapqueue
+
+import (
+	"container/heap"
+	"context"
+	"encoding/binary"
+	"github.com/pkg/errors"
+	"os"
+	"sync"
+	"time"
+)
+
+// prefix of items delayed till due time. Key is prefix, 8 bytes big-endian due time (unix nanoseconds) and
+// 8 bytes big-endian sequence number, so byte order of keys is the delivery order. Records are stored encoded
+// (see encode) and encrypted if encryption is enabled
+const schedulePrefix = metaPrefix + "schedule/"
+
+// marker of existing delayed items. Lets queue skip looking for delayed items while opening
+var scheduleMarkKey = []byte(metaPrefix + "scheduled")
+
+// interval before next attempt to move due items if previous attempt failed (for example queue is full)
+const scheduleRetry = time.Second
+
+func scheduleKey(at int64, seq int64) []byte {
+	var raw [16]byte
+	binary.BigEndian.PutUint64(raw[:8], uint64(at))
+	binary.BigEndian.PutUint64(raw[8:], uint64(seq))
+	return append([]byte(schedulePrefix), raw[:]...)
+}
+
+func parseScheduleKey(key []byte) (scheduled, bool) {
+	if len(key) != len(schedulePrefix)+16 {
+		return scheduled{}, false
+	}
+	raw := key[len(schedulePrefix):]
+	return scheduled{
+		at:  int64(binary.BigEndian.Uint64(raw[:8])),
+		seq: int64(binary.BigEndian.Uint64(raw[8:])),
+	}, true
+}
+
+type scheduled struct {
+	at  int64
+	seq int64
+}
+
+func (s scheduled) key() []byte { return scheduleKey(s.at, s.seq) }
+
+type scheduledHeap []scheduled
+
+func (h scheduledHeap) Len() int { return len(h) }
+
+func (h scheduledHeap) Less(i, j int) bool {
+	if h[i].at != h[j].at {
+		return h[i].at < h[j].at
+	}
+	return h[i].seq < h[j].seq
+}
+
+func (h scheduledHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+
+func (h *scheduledHeap) Push(x interface{}) { *h = append(*h, x.(scheduled)) }
+
+func (h *scheduledHeap) Pop() interface{} {
+	old := *h
+	item := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return item
+}
+
+// delayed items waiting for due time. Only keys are kept in memory
+type scheduler struct {
+	lock    sync.Mutex
+	move    sync.Mutex // serializes moving of due items to queue
+	pending scheduledHeap
+	nextSeq int64
+	timer   *time.Timer
+	wakeAt  int64
+	marked  bool // marker of delayed items is stored
+	stopped bool // queue is deleted, delayed items should not be moved
+}
+
+// Put item to queue which will not be visible for consumers before defined time. Item with time in past is put
+// immediately. Delayed items are stored in storage and survive restart, however they are not counted in queue
+// limits and size till due time. If queue is full at due time (see Reject and Block), item stays delayed and moving
+// is retried.
+func (q *Queue) PutAt(data []byte, at time.Time) error {
+	records, err := q.wrap([][]byte{data})
+	if err != nil {
+		return err
+	}
+	return q.putAt(records[0], at)
+}
+
+// Put item to queue which will not be visible for consumers till delay elapsed. See PutAt
+func (q *Queue) PutAfter(data []byte, delay time.Duration) error {
+	return q.PutAt(data, time.Now().Add(delay))
+}
+
+// Put item with metadata to queue which will not be visible for consumers before defined time. See PutAt
+func (q *Queue) PutEnvelopeAt(env *Envelope, at time.Time) error {
+	record, err := encodeEnvelope(env)
+	if err != nil {
+		return err
+	}
+	return q.putAt(record, at)
+}
+
+// Number of delayed items which are not yet visible in queue
+func (q *Queue) Scheduled() int {
+	q.scheduler.lock.Lock()
+	defer q.scheduler.lock.Unlock()
+	return len(q.scheduler.pending)
+}
+
+func (q *Queue) putAt(record []byte, at time.Time) error {
+	if !at.After(time.Now()) {
+		return q.put(context.Background(), [][]byte{record})
+	}
+	records, err := q.encode([][]byte{record})
+	if err != nil {
+		return err
+	}
+	record = records[0]
+	seal, err := q.sealer()
+	if err != nil {
+		return err
+	}
+	s := q.scheduler
+	s.lock.Lock()
+	item := scheduled{at: at.UnixNano(), seq: s.nextSeq}
+	if seal != nil {
+		// delayed record is encrypted for its own key and encrypted again while moving to queue
+		if record, err = seal.seal(item.key(), record); err != nil {
+			s.lock.Unlock()
+			return err
+		}
+	}
+	batch := &Batch{}
+	batch.Put(item.key(), record)
+	if !s.marked {
+		batch.Put(scheduleMarkKey, []byte{1})
+	}
+	if err := writeBatch(q.storage, batch); err != nil {
+		s.lock.Unlock()
+		return err
+	}
+	s.marked = true
+	s.nextSeq++
+	heap.Push(&s.pending, item)
+	q.armSchedule()
+	s.lock.Unlock()
+	return q.syncer.Wait(int64(len(record)))
+}
+
+// load keys of delayed items and start timer. Should be called once while opening queue
+func (j *journal) loadSchedule() error {
+	s := &scheduler{}
+	j.scheduler = s
+	_, err := j.storage.Get(scheduleMarkKey)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	s.marked = true
+	err = prefixKeys(j.storage, []byte(schedulePrefix), func(key []byte) error {
+		item, ok := parseScheduleKey(key)
+		if !ok {
+			j.logger.Println("skip invalid schedule key", key)
+			return nil
+		}
+		s.pending = append(s.pending, item)
+		if item.seq >= s.nextSeq {
+			s.nextSeq = item.seq + 1
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	heap.Init(&s.pending)
+	s.lock.Lock()
+	j.armSchedule()
+	s.lock.Unlock()
+	return nil
+}
+
+// stop moving of delayed items
+func (j *journal) stopSchedule() {
+	s := j.scheduler
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.stopped = true
+	if s.timer != nil {
+		s.timer.Stop()
+		s.timer = nil
+	}
+}
+
+// (re)start timer till earliest due time. Should be called under scheduler lock
+func (j *journal) armSchedule() {
+	s := j.scheduler
+	if len(s.pending) == 0 || s.stopped {
+		return
+	}
+	at := s.pending[0].at
+	if s.timer != nil && s.wakeAt <= at {
+		return
+	}
+	j.wakeAt(at)
+}
+
+// start timer at defined time. Should be called under scheduler lock
+func (j *journal) wakeAt(at int64) {
+	s := j.scheduler
+	if s.stopped {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	s.wakeAt = at
+	s.timer = time.AfterFunc(time.Until(time.Unix(0, at)), j.releaseDue)
+}
+
+// move due items to the tail of queue. Delayed records are deleted in the same batch as items are written
+func (j *journal) releaseDue() {
+	s := j.scheduler
+	s.move.Lock()
+	defer s.move.Unlock()
+
+	s.lock.Lock()
+	if s.stopped {
+		s.lock.Unlock()
+		return
+	}
+	s.timer = nil
+	now := time.Now().UnixNano()
+	var due []scheduled
+	for len(s.pending) > 0 && s.pending[0].at <= now {
+		due = append(due, heap.Pop(&s.pending).(scheduled))
+	}
+	s.lock.Unlock()
+
+	err := j.moveDue(due)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if err != nil {
+		j.logger.Println("failed move", len(due), "delayed items to queue:", err)
+		for _, item := range due {
+			heap.Push(&s.pending, item)
+		}
+		j.wakeAt(time.Now().Add(scheduleRetry).UnixNano())
+		return
+	}
+	if len(s.pending) == 0 && s.marked {
+		if err := j.storage.Del(scheduleMarkKey); err != nil {
+			j.logger.Println("failed remove marker of delayed items:", err)
+			return
+		}
+		s.marked = false
+	}
+	j.armSchedule()
+}
+
+func (j *journal) moveDue(due []scheduled) error {
+	if len(due) == 0 {
+		return nil
+	}
+	batch := &Batch{}
+	var records [][]byte
+	for _, item := range due {
+		record, err := j.storage.Get(item.key())
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		record, err = j.unseal(item.key(), record)
+		if err != nil {
+			return errors.Wrapf(err, "delayed item %v", item.seq)
+		}
+		records = append(records, record)
+		batch.Del(item.key())
+	}
+	// timer should not hang on full queue (see Block): moving is retried instead (see scheduleRetry)
+	return j.putWith(withoutWait(context.Background()), records, batch)
+}
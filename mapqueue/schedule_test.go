@@ -0,0 +1,93 @@
+package mapqueue
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"testing"
+	"time"
+)
+
+func popWithin(t *testing.T, queue *Queue, timeout time.Duration) string {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	data, err := queue.Pop(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+func TestQueue_PutAfter(t *testing.T) {
+	queue, err := NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const delay = 100 * time.Millisecond
+	started := time.Now()
+	if err := queue.PutAfter([]byte("late"), 2*delay); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutAfter([]byte("early"), delay); err != nil {
+		t.Fatal(err)
+	}
+	// item with time in past is put immediately
+	if err := queue.PutAt([]byte("now"), time.Now().Add(-time.Second)); err != nil {
+		t.Fatal(err)
+	}
+	if queue.Scheduled() != 2 || queue.Size() != 1 {
+		t.Fatal("delayed items are visible: scheduled", queue.Scheduled(), "size", queue.Size())
+	}
+	for _, expected := range []string{"now", "early", "late"} {
+		if data := popWithin(t, queue, 5*time.Second); data != expected {
+			t.Fatalf("expected %v, got %v", expected, data)
+		}
+	}
+	if elapsed := time.Since(started); elapsed < 2*delay {
+		t.Fatal("delayed item is delivered before due time:", elapsed)
+	}
+	if queue.Scheduled() != 0 {
+		t.Fatal("delivered items are still scheduled:", queue.Scheduled())
+	}
+}
+
+func TestQueue_PutAtAfterRestart(t *testing.T) {
+	storage := memstorage.New()
+	queue, err := NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutAt([]byte("delayed"), time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	queue, err = NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if queue.Scheduled() != 1 || !queue.Empty() {
+		t.Fatal("delayed item is not restored: scheduled", queue.Scheduled(), "size", queue.Size())
+	}
+}
+
+func TestQueue_PutAfterToBlockedQueue(t *testing.T) {
+	queue, err := New(memstorage.New()).Limit(1, 0, 0).Overflow(Block).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutAfter([]byte("b"), time.Millisecond); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	// timer does not wait for free space, item stays delayed till retry
+	if queue.Scheduled() != 1 {
+		t.Fatal("due item is not kept delayed while queue is full")
+	}
+	if data := popWithin(t, queue, time.Second); data != "a" {
+		t.Fatal("expected a, got", data)
+	}
+	if data := popWithin(t, queue, 5*time.Second); data != "b" {
+		t.Fatal("expected b, got", data)
+	}
+}
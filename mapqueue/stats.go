@@ -0,0 +1,104 @@
+package mapqueue
+
+import (
+	"math"
+	"os"
+	"time"
+)
+
+// time constant of averaging of rates
+const rateWindow = time.Minute
+
+// Snapshot of queue statistics. Counters and rates are collected since opening of queue.
+//
+// Some values are available only with specific options. Items and Bytes are -1 unless index of items is kept (see
+// TrackBytes and Limit). OldestAge is known only for items put with envelope (see PutEnvelope) or if max age is
+// limited, otherwise it is zero like for empty queue.
+type Stats struct {
+	Size        int64         // number of items available for consumer (see Size)
+	Items       int64         // number of items in storage including consumed but kept. -1 without TrackBytes or Limit
+	Bytes       int64         // total size of items in storage (as stored). -1 without TrackBytes or Limit
+	OldestAge   time.Duration // age of oldest item available for consumer. Zero if empty or enqueue time is unknown
+	Scheduled   int           // number of delayed items (see PutAt)
+	Enqueued    int64         // number of put items
+	Dequeued    int64         // number of items removed by consumer (including skipped missing items)
+	EnqueueRate float64       // put items per second averaged over last minute
+	DequeueRate float64       // removed items per second averaged over last minute
+	Gaps        int64         // number of missing items skipped while reading
+}
+
+// Keep index of items sizes to report total size of items in Stats. Index is built while opening queue by reading
+// all items. Enabled automatically if queue limits are defined (see Limit)
+func (qc *QueueConfig) TrackBytes() *QueueConfig {
+	qc.trackBytes = true
+	return qc
+}
+
+// Get statistics of queue
+func (q *Queue) Stats() Stats {
+	scheduled := q.Scheduled()
+	now := time.Now()
+	q.lock.RLock()
+	defer q.lock.RUnlock()
+	stats := Stats{
+		Size:        q.size(),
+		Items:       -1,
+		Bytes:       -1,
+		Scheduled:   scheduled,
+		Enqueued:    q.enqueued,
+		Dequeued:    q.dequeued,
+		EnqueueRate: q.enqueueRate.rate(now),
+		DequeueRate: q.dequeueRate.rate(now),
+		Gaps:        q.gaps,
+	}
+	if q.index != nil {
+		stats.Items = q.index.count
+		stats.Bytes = q.index.bytes
+	}
+	if enqueued, ok := q.oldestTime(); ok {
+		stats.OldestAge = now.Sub(enqueued)
+	}
+	return stats
+}
+
+// enqueue time of first available item. Known for items with envelope or if max age is limited.
+// Should be called under lock
+func (q *Queue) oldestTime() (time.Time, bool) {
+	for id := q.readId; id < q.writeId; id++ {
+		if q.committed[id] {
+			continue
+		}
+		record, err := q.storage.Get(itemKey(id))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return time.Time{}, false
+		}
+		if env, err := q.decodeEnvelope(id, record); err == nil && !env.Time.IsZero() {
+			return env.Time, true
+		}
+		if q.limits.maxAge > 0 && q.index != nil && !q.index.removed(id) {
+			return time.Unix(0, q.index.enqueued(id)), true
+		}
+		return time.Time{}, false
+	}
+	return time.Time{}, false
+}
+
+// exponentially weighted moving average of events per second
+type rateMeter struct {
+	value float64
+	last  time.Time
+}
+
+func (rm *rateMeter) add(events int64, now time.Time) {
+	rm.value = rm.rate(now) + float64(events)/rateWindow.Seconds()
+	rm.last = now
+}
+
+func (rm *rateMeter) rate(now time.Time) float64 {
+	if rm.last.IsZero() {
+		return 0
+	}
+	return rm.value * math.Exp(-now.Sub(rm.last).Seconds()/rateWindow.Seconds())
+}
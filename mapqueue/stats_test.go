@@ -0,0 +1,37 @@
+package mapqueue
+
+import (
+	"github.com/reddec/storages/memstorage"
+	"testing"
+	"time"
+)
+
+func TestQueue_StatsAvailability(t *testing.T) {
+	plain, err := NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := plain.PutString("item"); err != nil {
+		t.Fatal(err)
+	}
+	stats := plain.Stats()
+	if stats.Items != -1 || stats.Bytes != -1 || stats.OldestAge != 0 {
+		t.Fatalf("untracked values should be reported as not available: %+v", stats)
+	}
+
+	tracked, err := New(memstorage.New()).TrackBytes().Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := tracked.PutEnvelope(&Envelope{Data: []byte("item")}); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	stats = tracked.Stats()
+	if stats.Items != 1 || stats.Bytes <= 0 {
+		t.Fatalf("tracked size should be reported: %+v", stats)
+	}
+	if stats.OldestAge < 10*time.Millisecond {
+		t.Fatal("age of item with envelope should be reported, got", stats.OldestAge)
+	}
+}
@@ -175,6 +175,11 @@ func (htp *httpProcessor) requestUrl(ctx context.Context, url string, block []by
 	}
 	req = req.WithContext(ctx)
 	req.ContentLength = int64(len(block))
+	if env := stream.MessageEnvelope(ctx); env != nil {
+		for name, value := range env.Headers {
+			req.Header.Set(name, value)
+		}
+	}
 
 	res, err := htp.client.Do(req)
 	if err != nil {
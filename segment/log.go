@@ -0,0 +1,337 @@
+// Package segment contains append-only log in segmented files and queue over it.
+//
+// Each record is stored as 4 bytes big-endian length, 4 bytes big-endian CRC32 (Castagnoli) of length and payload,
+// and payload. Length is covered by checksum, so zero-filled tail is not a valid record.
+// Segment file is named by id of its first record. New segment is created once current one reaches segment size.
+// Partially written record at the end of last segment (after crash) is truncated while opening.
+package segment
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/reddec/wal/mapqueue"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	headerSize  = 8
+	segmentExt  = ".seg"
+	defaultSize = 64 * 1024 * 1024
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// The error occurred after access to record out of log
+var ErrNotFound = errors.New("record not found")
+
+// Log configuration builder
+type LogConfig struct {
+	dir         string
+	segmentSize int64
+	durability  mapqueue.Durability
+}
+
+// New log builder for directory. Default segment size is 64MB
+func New(dir string) *LogConfig {
+	return &LogConfig{dir: dir, segmentSize: defaultSize}
+}
+
+// Approximate maximum size of segment file in bytes. Segment could be bigger if contains single big record
+func (lc *LogConfig) SegmentSize(bytes int64) *LogConfig {
+	lc.segmentSize = bytes
+	return lc
+}
+
+// Policy of flushing appended records to disk. By default - OS managed
+func (lc *LogConfig) Durability(policy mapqueue.Durability) *LogConfig {
+	lc.durability = policy
+	return lc
+}
+
+// Open log: create directory if needed, scan segments and repair tail of last segment
+func (lc *LogConfig) Open() (*Log, error) {
+	err := os.MkdirAll(lc.dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(lc.dir)
+	if err != nil {
+		return nil, err
+	}
+	var firstIds []int64
+	for _, info := range files {
+		name := info.Name()
+		if info.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+		id, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			return nil, errors.Wrapf(err, "parse segment name %v", name)
+		}
+		firstIds = append(firstIds, id)
+	}
+	sort.Slice(firstIds, func(i, j int) bool { return firstIds[i] < firstIds[j] })
+
+	log := &Log{dir: lc.dir, segmentSize: lc.segmentSize, durability: lc.durability}
+	log.syncer = mapqueue.NewSyncer(lc.durability, log.Sync)
+	for i, id := range firstIds {
+		seg, err := openSegment(lc.dir, id, i == len(firstIds)-1)
+		if err != nil {
+			log.Close()
+			return nil, err
+		}
+		if len(log.segments) > 0 && log.nextId != id {
+			seg.file.Close()
+			log.Close()
+			return nil, errors.Errorf("segment %v: expected first id %v", seg.file.Name(), log.nextId)
+		}
+		log.segments = append(log.segments, seg)
+		log.nextId = id + int64(len(seg.offsets))
+	}
+	if len(log.segments) == 0 {
+		seg, err := createSegment(lc.dir, 0)
+		if err != nil {
+			return nil, err
+		}
+		log.segments = append(log.segments, seg)
+	}
+	return log, nil
+}
+
+// Append-only log in segmented files. Thread safe
+type Log struct {
+	lock        sync.RWMutex
+	dir         string
+	segmentSize int64
+	segments    []*segment
+	nextId      int64
+	durability  mapqueue.Durability
+	syncer      *mapqueue.Syncer
+}
+
+type segment struct {
+	firstId int64
+	file    *os.File
+	offsets []int64 // offset of each record in file
+	size    int64
+	dirty   bool // has not flushed data
+}
+
+// Id of first record in log
+func (l *Log) First() int64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.segments[0].firstId
+}
+
+// Id of next record that will be appended
+func (l *Log) Next() int64 {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	return l.nextId
+}
+
+// Append records to the end of log and return id of the first one. Records are written by single write call.
+// Returns after flush according to durability policy
+func (l *Log) Append(records ...[]byte) (int64, error) {
+	firstId, written, err := l.append(records)
+	if err != nil {
+		return 0, err
+	}
+	return firstId, l.syncer.Wait(written)
+}
+
+func (l *Log) append(records [][]byte) (int64, int64, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	seg := l.segments[len(l.segments)-1]
+	if seg.size >= l.segmentSize && len(seg.offsets) > 0 {
+		next, err := createSegment(l.dir, l.nextId)
+		if err != nil {
+			return 0, 0, err
+		}
+		l.segments = append(l.segments, next)
+		seg = next
+	}
+	var total int
+	for _, data := range records {
+		total += headerSize + len(data)
+	}
+	buffer := make([]byte, 0, total)
+	offsets := make([]int64, 0, len(records))
+	offset := seg.size
+	for _, data := range records {
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+		binary.BigEndian.PutUint32(header[4:], checksum(header[:4], data))
+		buffer = append(buffer, header[:]...)
+		buffer = append(buffer, data...)
+		offsets = append(offsets, offset)
+		offset += int64(headerSize + len(data))
+	}
+	_, err := seg.file.WriteAt(buffer, seg.size)
+	if err != nil {
+		// drop partially written data
+		if truncateErr := seg.file.Truncate(seg.size); truncateErr != nil {
+			return 0, 0, errors.Wrapf(truncateErr, "drop partially written records after %v", err)
+		}
+		return 0, 0, err
+	}
+	firstId := l.nextId
+	seg.offsets = append(seg.offsets, offsets...)
+	seg.size = offset
+	seg.dirty = true
+	l.nextId += int64(len(records))
+	return firstId, int64(total), nil
+}
+
+// Get record by id. Returns ErrNotFound if record is out of log
+func (l *Log) Get(id int64) ([]byte, error) {
+	l.lock.RLock()
+	defer l.lock.RUnlock()
+	if id < l.segments[0].firstId || id >= l.nextId {
+		return nil, ErrNotFound
+	}
+	i := sort.Search(len(l.segments), func(i int) bool { return l.segments[i].firstId > id }) - 1
+	seg := l.segments[i]
+	return seg.read(seg.offsets[id-seg.firstId], seg.size)
+}
+
+// Delete segments that contain only records before id. Active (last) segment is never deleted
+func (l *Log) Release(id int64) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for len(l.segments) > 1 && l.segments[1].firstId <= id {
+		seg := l.segments[0]
+		seg.file.Close()
+		if err := os.Remove(seg.file.Name()); err != nil {
+			return err
+		}
+		l.segments = l.segments[1:]
+	}
+	return nil
+}
+
+// Flush written data of all segments to disk
+func (l *Log) Sync() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	for _, seg := range l.segments {
+		if !seg.dirty {
+			continue
+		}
+		if err := seg.file.Sync(); err != nil {
+			return err
+		}
+		seg.dirty = false
+	}
+	return nil
+}
+
+// Close all segments files
+func (l *Log) Close() error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	var lastErr error
+	for _, seg := range l.segments {
+		if err := seg.file.Close(); err != nil {
+			lastErr = err
+		}
+	}
+	return lastErr
+}
+
+// Directory of log
+func (l *Log) Dir() string { return l.dir }
+
+func segmentName(dir string, firstId int64) string {
+	return filepath.Join(dir, fmt.Sprintf("%020d%v", firstId, segmentExt))
+}
+
+func createSegment(dir string, firstId int64) (*segment, error) {
+	f, err := os.OpenFile(segmentName(dir, firstId), os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return &segment{firstId: firstId, file: f}, nil
+}
+
+// open segment and index records. Broken tail of last segment is truncated, otherwise error returned
+func openSegment(dir string, firstId int64, last bool) (*segment, error) {
+	f, err := os.OpenFile(segmentName(dir, firstId), os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	seg := &segment{firstId: firstId, file: f}
+	for seg.size < info.Size() {
+		size, err := seg.check(seg.size, info.Size())
+		if err != nil {
+			if !last {
+				f.Close()
+				return nil, errors.Wrapf(err, "segment %v at offset %v", f.Name(), seg.size)
+			}
+			if err := f.Truncate(seg.size); err != nil {
+				f.Close()
+				return nil, err
+			}
+			break
+		}
+		seg.offsets = append(seg.offsets, seg.size)
+		seg.size += size
+	}
+	return seg, nil
+}
+
+// read record at offset and check CRC. Record should end before end offset
+func (seg *segment) read(offset int64, end int64) ([]byte, error) {
+	var header [headerSize]byte
+	_, err := seg.file.ReadAt(header[:], offset)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	size := int64(binary.BigEndian.Uint32(header[:4]))
+	if size > end-offset-headerSize {
+		return nil, io.ErrUnexpectedEOF
+	}
+	data := make([]byte, size)
+	_, err = seg.file.ReadAt(data, offset+headerSize)
+	if err == io.EOF {
+		return nil, io.ErrUnexpectedEOF
+	} else if err != nil {
+		return nil, err
+	}
+	if checksum(header[:4], data) != binary.BigEndian.Uint32(header[4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return data, nil
+}
+
+// check record at offset and return its full size
+func (seg *segment) check(offset int64, end int64) (int64, error) {
+	data, err := seg.read(offset, end)
+	if err != nil {
+		return 0, err
+	}
+	return int64(headerSize + len(data)), nil
+}
+
+// CRC of record length and payload
+func checksum(length []byte, data []byte) uint32 {
+	return crc32.Update(crc32.Checksum(length, crcTable), crcTable, data)
+}
@@ -0,0 +1,135 @@
+package segment
+
+import (
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func openTestLog(t *testing.T, dir string) *Log {
+	log, err := New(dir).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return log
+}
+
+// append records, close log and damage tail of the segment by callback
+func prepareDamaged(t *testing.T, damage func(f *os.File, size int64)) string {
+	dir, err := ioutil.TempDir("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	log := openTestLog(t, dir)
+	if _, err := log.Append([]byte("alpha"), []byte("beta")); err != nil {
+		t.Fatal(err)
+	}
+	log.Close()
+	f, err := os.OpenFile(segmentName(dir, 0), os.O_RDWR, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		t.Fatal(err)
+	}
+	damage(f, info.Size())
+	return dir
+}
+
+func checkRecovered(t *testing.T, dir string) {
+	log := openTestLog(t, dir)
+	defer log.Close()
+	if log.Next() != 2 {
+		t.Fatal("expected 2 records after recovery, got", log.Next())
+	}
+	for id, expected := range []string{"alpha", "beta"} {
+		data, err := log.Get(int64(id))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(data) != expected {
+			t.Fatalf("record %v: expected %v, got %v", id, expected, string(data))
+		}
+	}
+	id, err := log.Append([]byte("gamma"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id != 2 {
+		t.Fatal("expected appended id 2, got", id)
+	}
+	data, err := log.Get(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "gamma" {
+		t.Fatal("expected gamma, got", string(data))
+	}
+}
+
+func TestLog_recoverPartialRecord(t *testing.T) {
+	dir := prepareDamaged(t, func(f *os.File, size int64) {
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], 10)
+		if _, err := f.WriteAt(append(header[:], "abc"...), size); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(dir)
+	checkRecovered(t, dir)
+}
+
+func TestLog_recoverZeroTail(t *testing.T) {
+	dir := prepareDamaged(t, func(f *os.File, size int64) {
+		if _, err := f.WriteAt(make([]byte, 64), size); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(dir)
+	checkRecovered(t, dir)
+}
+
+func TestLog_recoverHugeLength(t *testing.T) {
+	dir := prepareDamaged(t, func(f *os.File, size int64) {
+		var header [headerSize]byte
+		binary.BigEndian.PutUint32(header[:4], 0xFFFFFFFF)
+		if _, err := f.WriteAt(header[:], size); err != nil {
+			t.Fatal(err)
+		}
+	})
+	defer os.RemoveAll(dir)
+	checkRecovered(t, dir)
+}
+
+func TestLog_brokenSealedSegment(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	log, err := New(dir).SegmentSize(1).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range []string{"alpha", "beta"} {
+		if _, err := log.Append([]byte(item)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	log.Close()
+	f, err := os.OpenFile(segmentName(dir, 0), os.O_RDWR|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = f.Write(make([]byte, 64))
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := New(dir).Open(); err == nil {
+		t.Fatal("expected error on broken not last segment")
+	}
+}
@@ -0,0 +1,141 @@
+package segment
+
+import (
+	"github.com/reddec/wal/mapqueue"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const cursorFile = "cursor"
+
+// Queue over segmented log. Read pointer is persisted in separate file in log directory and fully consumed
+// segments are deleted. Read pointer is flushed to disk on each move unless durability of log is OS managed.
+// Thread safe
+type Queue struct {
+	onCreated mapqueue.Notification
+	log       *Log
+	lock      sync.Mutex
+	readId    int64
+}
+
+// Create queue over log and restore read pointer
+func NewQueue(log *Log) (*Queue, error) {
+	q := &Queue{log: log, readId: log.First()}
+	data, err := ioutil.ReadFile(filepath.Join(log.Dir(), cursorFile))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if err == nil {
+		readId, err := strconv.ParseInt(strings.TrimSpace(string(data)), 10, 64)
+		if err != nil {
+			return nil, err
+		}
+		if readId > q.readId {
+			q.readId = readId
+		}
+		if next := log.Next(); q.readId > next {
+			q.readId = next
+		}
+	}
+	return q, nil
+}
+
+// Get notifications manager for new items event
+func (q *Queue) OnCreated() *mapqueue.Notification { return &q.onCreated }
+
+// Check is queue empty
+func (q *Queue) Empty() bool { return q.Size() == 0 }
+
+// Size of queue
+func (q *Queue) Size() int64 {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	return q.log.Next() - q.readId
+}
+
+// Put data to the tail of queue
+func (q *Queue) Put(data []byte) error { return q.PutBatch([][]byte{data}) }
+
+// Put several items to the tail of queue by single write
+func (q *Queue) PutBatch(items [][]byte) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := q.log.Append(items...)
+	if err != nil {
+		return err
+	}
+	q.onCreated.Notify()
+	return nil
+}
+
+// Head value of queue
+func (q *Queue) Head() ([]byte, error) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if q.readId >= q.log.Next() {
+		return nil, mapqueue.ErrEmpty
+	}
+	return q.log.Get(q.readId)
+}
+
+// Remove head item from queue
+func (q *Queue) Remove() error { return q.RemoveN(1) }
+
+// Remove up to N items from head of queue
+func (q *Queue) RemoveN(n int) error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	readId := q.readId + int64(n)
+	if next := q.log.Next(); readId > next {
+		readId = next
+	}
+	if readId == q.readId {
+		return nil
+	}
+	flush := q.log.durability != mapqueue.OSManaged()
+	err := writeFile(filepath.Join(q.log.Dir(), cursorFile), []byte(strconv.FormatInt(readId, 10)), flush)
+	if err != nil {
+		return err
+	}
+	q.readId = readId
+	return q.log.Release(readId)
+}
+
+// Underline log
+func (q *Queue) Log() *Log { return q.log }
+
+// atomically replace file content. If flush is set, content and rename are flushed to disk before return
+func writeFile(name string, data []byte, flush bool) error {
+	tmp := name + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil && flush {
+		err = f.Sync()
+	}
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, name); err != nil {
+		return err
+	}
+	if !flush {
+		return nil
+	}
+	dir, err := os.Open(filepath.Dir(name))
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
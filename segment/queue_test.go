@@ -0,0 +1,152 @@
+package segment
+
+import (
+	"github.com/reddec/wal/mapqueue"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func openTestQueue(t *testing.T, dir string) *Queue {
+	log, err := New(dir).SegmentSize(64).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, err := NewQueue(log)
+	if err != nil {
+		log.Close()
+		t.Fatal(err)
+	}
+	return queue
+}
+
+func segmentsCount(t *testing.T, dir string) int {
+	files, err := filepath.Glob(filepath.Join(dir, "*"+segmentExt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(files)
+}
+
+func TestQueue(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	queue := openTestQueue(t, dir)
+	if _, err := queue.Head(); err != mapqueue.ErrEmpty {
+		t.Fatal("expected empty queue, got", err)
+	}
+	sub := queue.OnCreated().Subscribe()
+	defer sub.Close()
+	if err := queue.Put([]byte("first")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-sub.Wait():
+	case <-time.After(time.Second):
+		t.Fatal("subscribers are not notified about new item")
+	}
+	// segment is rotated before append, so batches of 2 items are spread over several segments
+	for i := 0; i < 10; i++ {
+		if err := queue.PutBatch([][]byte{[]byte("item of some size"), []byte("item of some size")}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if queue.Size() != 21 || queue.Empty() {
+		t.Fatal("expected 21 items, got", queue.Size())
+	}
+	head, err := queue.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head) != "first" {
+		t.Fatal("expected first, got", string(head))
+	}
+	segments := segmentsCount(t, dir)
+	if segments < 3 {
+		t.Fatal("expected several segments, got", segments)
+	}
+
+	// consumed segments are deleted
+	if err := queue.RemoveN(11); err != nil {
+		t.Fatal(err)
+	}
+	if count := segmentsCount(t, dir); count >= segments {
+		t.Fatal("consumed segments are not deleted:", count)
+	}
+	queue.Log().Close()
+
+	// read pointer survives reopen
+	queue = openTestQueue(t, dir)
+	defer queue.Log().Close()
+	if queue.Size() != 10 {
+		t.Fatal("expected 10 items after reopen, got", queue.Size())
+	}
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	// removing more items than queue has empties queue
+	if err := queue.RemoveN(100); err != nil {
+		t.Fatal(err)
+	}
+	if !queue.Empty() {
+		t.Fatal("queue should be empty, size", queue.Size())
+	}
+	if _, err := queue.Head(); err != mapqueue.ErrEmpty {
+		t.Fatal("expected empty queue, got", err)
+	}
+	if err := queue.Put([]byte("last")); err != nil {
+		t.Fatal(err)
+	}
+	head, err = queue.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head) != "last" {
+		t.Fatal("expected last, got", string(head))
+	}
+}
+
+func TestQueue_syncedCursor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "segment-queue")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	open := func() *Queue {
+		log, err := New(dir).Durability(mapqueue.SyncAlways()).Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		queue, err := NewQueue(log)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return queue
+	}
+	queue := open()
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, cursorFile+".tmp")); !os.IsNotExist(err) {
+		t.Fatal("temporary cursor file is left:", err)
+	}
+	queue.Log().Close()
+
+	queue = open()
+	defer queue.Log().Close()
+	head, err := queue.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(head) != "b" {
+		t.Fatal("expected b, got", string(head))
+	}
+}
@@ -0,0 +1,133 @@
+package strategy
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Kind of randomization for exponential backoff
+type Jitter int
+
+const (
+	// Exact exponential delay without randomization
+	NoJitter Jitter = 0
+	// Random delay between zero and exponential delay
+	FullJitter Jitter = 1
+	// Half of exponential delay plus random value up to the other half
+	EqualJitter Jitter = 2
+	// Random delay between base and previous delay multiplied by multiplier
+	DecorrelatedJitter Jitter = 3
+)
+
+type attemptKey struct{}
+
+// Attach attempt number (starting from 1) of current message to context. Stream sets it for handlers and strategies
+func WithAttempt(ctx context.Context, attempt int) context.Context {
+	return context.WithValue(ctx, attemptKey{}, attempt)
+}
+
+// Attempt number (starting from 1) of current message or 0 if not defined in context
+func Attempt(ctx context.Context) int {
+	attempt, _ := ctx.Value(attemptKey{}).(int)
+	return attempt
+}
+
+type messageKey struct{}
+
+// state of current message between attempts
+type message struct {
+	delay time.Duration // last backoff delay
+}
+
+// Attach state of current message to context, so strategies keep state between attempts of message (like previous
+// delay of decorrelated jitter) without sharing it with other messages. Stream sets it once for each message
+func WithMessage(ctx context.Context) context.Context {
+	return context.WithValue(ctx, messageKey{}, &message{})
+}
+
+// exponential backoff has no mutable state, so it could be shared by parallel workers
+type exponential struct {
+	base       time.Duration
+	maxDelay   time.Duration
+	multiplier float64
+	jitter     Jitter
+}
+
+func (ex *exponential) Done(ctx context.Context, err error) error {
+	if err == nil {
+		return nil
+	}
+	select {
+	case <-time.After(ex.next(ctx)):
+		return err // returns err means retry
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func (ex *exponential) next(ctx context.Context) time.Duration {
+	attempt := Attempt(ctx)
+	if attempt <= 0 {
+		attempt = 1
+	}
+	msg, _ := ctx.Value(messageKey{}).(*message)
+	var delay time.Duration
+	switch ex.jitter {
+	case FullJitter:
+		delay = randomDuration(0, ex.exp(attempt))
+	case EqualJitter:
+		half := ex.exp(attempt) / 2
+		delay = half + randomDuration(0, half)
+	case DecorrelatedJitter:
+		previous := ex.base
+		if msg != nil && msg.delay > previous && attempt > 1 {
+			previous = msg.delay
+		}
+		delay = randomDuration(ex.base, ex.limit(float64(previous)*ex.multiplier))
+	default:
+		delay = ex.exp(attempt)
+	}
+	if msg != nil {
+		msg.delay = delay
+	}
+	return delay
+}
+
+// base * multiplier^(attempt-1) limited by max delay
+func (ex *exponential) exp(attempt int) time.Duration {
+	return ex.limit(float64(ex.base) * math.Pow(ex.multiplier, float64(attempt-1)))
+}
+
+func (ex *exponential) limit(delay float64) time.Duration {
+	if ex.maxDelay > 0 && delay > float64(ex.maxDelay) {
+		return ex.maxDelay
+	}
+	if delay > math.MaxInt64 {
+		return math.MaxInt64
+	}
+	return time.Duration(delay)
+}
+
+func randomDuration(from, to time.Duration) time.Duration {
+	if to <= from {
+		return from
+	}
+	return from + time.Duration(rand.Int63n(int64(to-from)))
+}
+
+// Exponential backoff before attempt after error. Delay is base*multiplier^(attempt-1) limited by maxDelay
+// (0 means no limit) and randomized by jitter. Attempt number is taken from context (see Attempt), without it delay
+// of first attempt is used. Previous delay for decorrelated jitter is kept per message (see WithMessage)
+func Exponential(base time.Duration, multiplier float64, maxDelay time.Duration, jitter Jitter) FinishStrategy {
+	if multiplier < 1 {
+		multiplier = 1
+	}
+	return &exponential{
+		base:       base,
+		multiplier: multiplier,
+		maxDelay:   maxDelay,
+		jitter:     jitter,
+	}
+}
@@ -0,0 +1,99 @@
+package strategy
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+func backoff(base time.Duration, multiplier float64, maxDelay time.Duration, jitter Jitter) *exponential {
+	return Exponential(base, multiplier, maxDelay, jitter).(*exponential)
+}
+
+func TestExponential_growth(t *testing.T) {
+	ex := backoff(10*time.Millisecond, 2, 0, NoJitter)
+	ctx := WithMessage(context.Background())
+	for attempt, expected := range []time.Duration{10, 20, 40, 80, 160} {
+		delay := ex.next(WithAttempt(ctx, attempt+1))
+		if delay != expected*time.Millisecond {
+			t.Fatalf("attempt %v: expected %v, got %v", attempt+1, expected*time.Millisecond, delay)
+		}
+	}
+	if delay := ex.next(context.Background()); delay != 10*time.Millisecond {
+		t.Fatal("without attempt in context delay of first attempt expected, got", delay)
+	}
+}
+
+func TestExponential_maxDelay(t *testing.T) {
+	ex := backoff(10*time.Millisecond, 2, 50*time.Millisecond, NoJitter)
+	if delay := ex.next(WithAttempt(context.Background(), 10)); delay != 50*time.Millisecond {
+		t.Fatal("delay is not limited:", delay)
+	}
+	// overflow of exponent is limited too
+	if delay := ex.next(WithAttempt(context.Background(), 10000)); delay != 50*time.Millisecond {
+		t.Fatal("delay is not limited:", delay)
+	}
+}
+
+func TestExponential_jitter(t *testing.T) {
+	const base, maxDelay = 10 * time.Millisecond, 100 * time.Millisecond
+	for i := 0; i < 100; i++ {
+		attempt := WithAttempt(context.Background(), 3) // 40ms without jitter
+		if delay := backoff(base, 2, maxDelay, FullJitter).next(attempt); delay < 0 || delay > 40*time.Millisecond {
+			t.Fatal("full jitter out of range:", delay)
+		}
+		if delay := backoff(base, 2, maxDelay, EqualJitter).next(attempt); delay < 20*time.Millisecond || delay > 40*time.Millisecond {
+			t.Fatal("equal jitter out of range:", delay)
+		}
+	}
+	ex := backoff(base, 3, maxDelay, DecorrelatedJitter)
+	ctx := WithMessage(context.Background())
+	previous := base
+	for attempt := 1; attempt <= 20; attempt++ {
+		delay := ex.next(WithAttempt(ctx, attempt))
+		limit := 3 * previous
+		if limit > maxDelay {
+			limit = maxDelay
+		}
+		if delay < base || delay > limit {
+			t.Fatalf("attempt %v: decorrelated jitter %v out of range [%v, %v]", attempt, delay, base, limit)
+		}
+		previous = delay
+		if previous < base {
+			previous = base
+		}
+	}
+}
+
+func TestExponential_perMessage(t *testing.T) {
+	const base = 10 * time.Millisecond
+	ex := backoff(base, 10, time.Hour, DecorrelatedJitter)
+	failing := WithMessage(context.Background())
+	for attempt := 1; attempt <= 5; attempt++ {
+		ex.next(WithAttempt(failing, attempt))
+	}
+	// failures of other message (or of previous message before success) do not increase delay
+	for i := 0; i < 100; i++ {
+		if delay := ex.next(WithAttempt(WithMessage(context.Background()), 1)); delay > 10*base {
+			t.Fatal("delay of first attempt depends on other message:", delay)
+		}
+	}
+}
+
+func TestExponential_done(t *testing.T) {
+	ex := Exponential(time.Millisecond, 2, 0, NoJitter)
+	if err := ex.Done(context.Background(), nil); err != nil {
+		t.Fatal("success should be committed, got", err)
+	}
+	failure := errors.New("failure")
+	if err := ex.Done(context.Background(), failure); err != failure {
+		t.Fatal("failure should be retried, got", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	slow := Exponential(time.Hour, 2, 0, NoJitter)
+	if err := slow.Done(ctx, failure); err != context.Canceled {
+		t.Fatal("backoff should be interrupted by context, got", err)
+	}
+}
@@ -0,0 +1,48 @@
+package stream
+
+import (
+	"encoding/json"
+	"time"
+)
+
+// Message that was moved to dead-letter queue after exceeding maximum number of attempts.
+// Dead letters are stored in queue encoded as JSON
+type DeadLetter struct {
+	Data     []byte    `json:"data"`     // original message
+	Error    string    `json:"error"`    // last processing error
+	Attempts int       `json:"attempts"` // number of failed attempts
+	Time     time.Time `json:"time"`     // time when message was moved
+}
+
+// Decode dead letter from dead-letter queue item
+func ParseDeadLetter(data []byte) (*DeadLetter, error) {
+	var letter DeadLetter
+	err := json.Unmarshal(data, &letter)
+	if err != nil {
+		return nil, err
+	}
+	return &letter, nil
+}
+
+// put items to dead-letter queue (or drop them if queue not defined). Items should be committed by caller
+func (s *Stream) deadLetter(items [][]byte, attempts int, lastErr error) error {
+	if s.cfg.deadLetters == nil {
+		s.cfg.logger.Println("dropped", len(items), "message(s) after", attempts, "attempts:", lastErr)
+		return nil
+	}
+	now := time.Now()
+	var letters = make([][]byte, 0, len(items))
+	for _, data := range items {
+		letter, err := json.Marshal(&DeadLetter{Data: data, Error: lastErr.Error(), Attempts: attempts, Time: now})
+		if err != nil {
+			return err
+		}
+		letters = append(letters, letter)
+	}
+	err := s.cfg.deadLetters.PutBatch(letters)
+	if err != nil {
+		return err
+	}
+	s.cfg.logger.Println("moved", len(items), "message(s) to dead-letter queue after", attempts, "attempts:", lastErr)
+	return nil
+}
@@ -0,0 +1,95 @@
+package stream
+
+import (
+	"context"
+	"errors"
+	"github.com/reddec/storages/memstorage"
+	"github.com/reddec/wal/mapqueue"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// start stream which fails on "bad" items and collects successfully processed items
+func startPoisoned(t *testing.T, deadLetters *mapqueue.Queue, maxAttempts int, items ...string) (*mapqueue.Queue, *Stream, <-chan string, *int64) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if err := queue.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var failures int64
+	delivered := make(chan string, len(items))
+	stream := New(queue).Strategy(nil).DeadLetter(maxAttempts, deadLetters).Process(func(ctx context.Context, data []byte) error {
+		if string(data) == "bad" {
+			atomic.AddInt64(&failures, 1)
+			return errors.New("boom")
+		}
+		delivered <- string(data)
+		return nil
+	}).Start()
+	return queue, stream, delivered, &failures
+}
+
+func expectGood(t *testing.T, stream *Stream, delivered <-chan string) {
+	select {
+	case item := <-delivered:
+		if item != "good" {
+			t.Fatal("expected good, got", item)
+		}
+	case err := <-stream.Done():
+		t.Fatal("stream stopped:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for good item")
+	}
+}
+
+// wait till processed items are committed
+func waitEmpty(t *testing.T, queue *mapqueue.Queue) {
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("processed items are not removed from queue, size", queue.Size())
+		}
+	}
+}
+
+func TestStream_deadLetter(t *testing.T) {
+	deadLetters, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	queue, stream, delivered, failures := startPoisoned(t, deadLetters, 3, "bad", "good")
+	defer stream.Stop()
+	expectGood(t, stream, delivered)
+	if n := atomic.LoadInt64(failures); n != 3 {
+		t.Fatal("expected 3 attempts, got", n)
+	}
+	waitEmpty(t, queue)
+	data, err := deadLetters.Head()
+	if err != nil {
+		t.Fatal(err)
+	}
+	letter, err := ParseDeadLetter(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(letter.Data) != "bad" || letter.Attempts != 3 || letter.Error != "boom" {
+		t.Fatalf("unexpected dead letter: %+v", letter)
+	}
+	if letter.Time.IsZero() || time.Since(letter.Time) > time.Minute {
+		t.Fatal("unexpected time of dead letter:", letter.Time)
+	}
+}
+
+func TestStream_deadLetterDropped(t *testing.T) {
+	queue, stream, delivered, failures := startPoisoned(t, nil, 2, "bad", "good")
+	defer stream.Stop()
+	expectGood(t, stream, delivered)
+	if n := atomic.LoadInt64(failures); n != 2 {
+		t.Fatal("expected 2 attempts, got", n)
+	}
+	waitEmpty(t, queue)
+}
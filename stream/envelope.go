@@ -0,0 +1,22 @@
+package stream
+
+import (
+	"context"
+	"github.com/reddec/wal/mapqueue"
+)
+
+type envelopeKey struct{}
+
+type envelopesKey struct{}
+
+// Metadata of currently processed message or nil. Defined in context of handlers set by Process or Handle
+func MessageEnvelope(ctx context.Context) *mapqueue.Envelope {
+	env, _ := ctx.Value(envelopeKey{}).(*mapqueue.Envelope)
+	return env
+}
+
+// Metadata of currently processed batch in the same order as items or nil. Defined in context of all handlers
+func BatchEnvelopes(ctx context.Context) []*mapqueue.Envelope {
+	envelopes, _ := ctx.Value(envelopesKey{}).([]*mapqueue.Envelope)
+	return envelopes
+}
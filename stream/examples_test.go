@@ -78,3 +78,49 @@ func ExampleNew_persistent() {
 	// Output:
 	// message got test
 }
+
+func ExampleStreamConfig_Batch() {
+	// prepare in-memory queue
+	queue, _ := mapqueue.NewMapQueue(memstorage.New())
+	// push test messages before start to get them in one batch
+	queue.PutBatch([][]byte{[]byte("a"), []byte("b"), []byte("c")})
+
+	done := make(chan struct{})
+	// up to 2 items per batch without size limit and without waiting for new items
+	stream := New(queue).Batch(2, 0, 0).ProcessBatch(func(ctx context.Context, items [][]byte) error {
+		fmt.Println("batch of", len(items))
+		if queue.Size() == int64(len(items)) {
+			close(done)
+		}
+		return nil
+	}).Start()
+
+	<-done
+	stream.Stop()
+	// Output:
+	// batch of 2
+	// batch of 1
+}
+
+func ExampleNewPriority() {
+	// prepare in-memory queue with two priority levels
+	queue, _ := mapqueue.New(memstorage.New()).OpenPriority(2)
+	// push bulk message first and urgent message after
+	queue.Put(1, []byte("bulk"))
+	queue.Put(0, []byte("urgent"))
+
+	done := make(chan struct{})
+	stream := NewPriority(queue).Process(func(ctx context.Context, data []byte) error {
+		fmt.Println("message got", string(data))
+		if queue.Size() == 1 {
+			close(done)
+		}
+		return nil
+	}).Start()
+
+	<-done
+	stream.Stop()
+	// Output:
+	// message got urgent
+	// message got bulk
+}
@@ -0,0 +1,108 @@
+package stream
+
+import (
+	"sync"
+	"time"
+)
+
+// State of stream processing
+type State int
+
+const (
+	// Waiting for new messages
+	Idle State = 0
+	// Handlers are running
+	Processing State = 1
+	// Waiting before next attempt after failure (see strategy)
+	BackingOff State = 2
+	// Stream is finished
+	Stopped State = 3
+)
+
+func (st State) String() string {
+	switch st {
+	case Idle:
+		return "idle"
+	case Processing:
+		return "processing"
+	case BackingOff:
+		return "backing off"
+	case Stopped:
+		return "stopped"
+	default:
+		return "unknown"
+	}
+}
+
+// Snapshot of stream statistics. Counters are collected since start of stream
+type Stats struct {
+	State         State     // current state. If at least one worker is backing off, stream is backing off
+	Processed     int64     // number of successfully processed messages
+	Retries       int64     // number of repeated attempts of processing
+	Failures      int64     // number of failed attempts of processing
+	DeadLetters   int64     // number of messages moved to dead-letter queue (or dropped) after last attempt
+	LastError     error     // error of last failed attempt
+	LastErrorTime time.Time // time of last failed attempt
+	LastSuccess   time.Time // time of last successful attempt
+}
+
+type streamStats struct {
+	lock       sync.Mutex
+	stats      Stats
+	active     int // number of messages (batches) in processing
+	backingOff int // number of messages (batches) waiting for next attempt
+	stopped    bool
+}
+
+// Get statistics of stream
+func (s *Stream) Stats() Stats {
+	s.stats.lock.Lock()
+	defer s.stats.lock.Unlock()
+	stats := s.stats.stats
+	switch {
+	case s.stats.stopped:
+		stats.State = Stopped
+	case s.stats.backingOff > 0:
+		stats.State = BackingOff
+	case s.stats.active > 0:
+		stats.State = Processing
+	default:
+		stats.State = Idle
+	}
+	return stats
+}
+
+func (ss *streamStats) update(fn func()) {
+	ss.lock.Lock()
+	fn()
+	ss.lock.Unlock()
+}
+
+func (ss *streamStats) begin() { ss.update(func() { ss.active++ }) }
+
+func (ss *streamStats) end() { ss.update(func() { ss.active-- }) }
+
+func (ss *streamStats) stop() { ss.update(func() { ss.stopped = true }) }
+
+func (ss *streamStats) retry() { ss.update(func() { ss.stats.Retries++ }) }
+
+func (ss *streamStats) giveUp(n int) { ss.update(func() { ss.stats.DeadLetters += int64(n) }) }
+
+func (ss *streamStats) backOff() { ss.update(func() { ss.backingOff++ }) }
+
+func (ss *streamStats) resume() { ss.update(func() { ss.backingOff-- }) }
+
+func (ss *streamStats) success(n int) {
+	ss.update(func() {
+		ss.stats.Processed += int64(n)
+		ss.stats.LastSuccess = time.Now()
+	})
+}
+
+func (ss *streamStats) failure(err error) {
+	ss.update(func() {
+		ss.stats.Failures++
+		ss.stats.LastError = err
+		ss.stats.LastErrorTime = time.Now()
+	})
+}
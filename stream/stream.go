@@ -13,10 +13,24 @@ import (
 // Stream configuration builder
 type StreamConfig struct {
 	queue    *mapqueue.Queue
-	handlers []StreamHandlerFunc
+	priority *mapqueue.PriorityQueue
+	handlers []StreamBatchHandlerFunc
 	strategy strategy.FinishStrategy
 	logger   Logger
 	ctx      context.Context
+	batch    batchConfig
+
+	maxAttempts int
+	deadLetters *mapqueue.Queue
+
+	workers int
+	commit  CommitMode
+}
+
+type batchConfig struct {
+	maxItems int
+	maxBytes int
+	linger   time.Duration
 }
 
 // Function that processing package
@@ -27,6 +41,14 @@ type StreamHandler interface {
 	Handle(ctx context.Context, data []byte) error
 }
 
+// Function that processing batch of packages. Batch is committed only if whole batch processed without error
+type StreamBatchHandlerFunc func(ctx context.Context, items [][]byte) error
+
+type StreamBatchHandler interface {
+	// Handle batch of incoming messages
+	HandleBatch(ctx context.Context, items [][]byte) error
+}
+
 // New stream builder. Builder should not be used after final method (Start()).
 // Default parameters is: delay strategy (5s retry and 3s jitter), no logging and background context
 func New(queue *mapqueue.Queue) *StreamConfig {
@@ -35,9 +57,18 @@ func New(queue *mapqueue.Queue) *StreamConfig {
 		ctx:      context.Background(),
 		strategy: strategy.Delay(5*time.Second, 3*time.Second),
 		logger:   log.New(ioutil.Discard, "", log.LstdFlags),
+		batch:    batchConfig{maxItems: 1},
 	}
 }
 
+// New stream builder over priority queue. Lanes are drained as defined by priority queue (see PriorityQueue.Next):
+// each batch is read from single lane. Parallel workers are not supported for priority queue and ignored
+func NewPriority(queue *mapqueue.PriorityQueue) *StreamConfig {
+	sc := New(nil)
+	sc.priority = queue
+	return sc
+}
+
 // Set logger for stream
 func (sc *StreamConfig) Logger(logger Logger) *StreamConfig {
 	sc.logger = logger
@@ -56,9 +87,22 @@ func (sc *StreamConfig) Context(ctx context.Context) *StreamConfig {
 }
 
 // Set processor. Multiple processor will be invoked sequentially as defined if no error occurred.
+// In batch mode processor is invoked for each item of batch sequentially, and whole batch is processed by one
+// processor before next one
 func (sc *StreamConfig) Process(handler StreamHandlerFunc) *StreamConfig {
-	sc.handlers = append(sc.handlers, handler)
-	return sc
+	return sc.ProcessBatch(func(ctx context.Context, items [][]byte) error {
+		envelopes := BatchEnvelopes(ctx)
+		for i, data := range items {
+			itemCtx := ctx
+			if i < len(envelopes) {
+				itemCtx = context.WithValue(ctx, envelopeKey{}, envelopes[i])
+			}
+			if err := handler(itemCtx, data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
 }
 
 // Set processor object. Multiple processor will be invoked sequentially as defined if no error occurred.
@@ -66,6 +110,29 @@ func (sc *StreamConfig) Handle(handler StreamHandler) *StreamConfig {
 	return sc.Process(handler.Handle)
 }
 
+// Set batch processor. Multiple processor will be invoked sequentially as defined if no error occurred.
+// Without batch mode (see Batch) processor receives exactly one item
+func (sc *StreamConfig) ProcessBatch(handler StreamBatchHandlerFunc) *StreamConfig {
+	sc.handlers = append(sc.handlers, handler)
+	return sc
+}
+
+// Set batch processor object. Multiple processor will be invoked sequentially as defined if no error occurred.
+func (sc *StreamConfig) HandleBatch(handler StreamBatchHandler) *StreamConfig {
+	return sc.ProcessBatch(handler.HandleBatch)
+}
+
+// Enable batch mode. Batch contains up to maxItems items and up to maxBytes of payload (0 means no limit), but
+// at least one item even if it is bigger. If queue contains less than maxItems, stream waits up to linger time for
+// new items before processing. By default batch mode is disabled (one item, no limits, no linger)
+func (sc *StreamConfig) Batch(maxItems int, maxBytes int, linger time.Duration) *StreamConfig {
+	if maxItems < 1 {
+		maxItems = 1
+	}
+	sc.batch = batchConfig{maxItems: maxItems, maxBytes: maxBytes, linger: linger}
+	return sc
+}
+
 // Set finalizing strategy. By default - delay (5s retry on retry with 3s jitter). Can be nil.
 // If strategy returns nil, message is committed otherwise repeated without delay.
 func (sc *StreamConfig) Strategy(strategy strategy.FinishStrategy) *StreamConfig {
@@ -73,6 +140,27 @@ func (sc *StreamConfig) Strategy(strategy strategy.FinishStrategy) *StreamConfig
 	return sc
 }
 
+// Limit number of attempts for each message (or batch). After maxAttempts failed attempts message is moved to
+// dead-letter queue as DeadLetter record and stream continues with next message. If dead-letter queue is nil, message
+// is dropped. Zero or negative maxAttempts means unlimited attempts (default).
+//
+// In batch mode attempts are counted for whole batch, so all items of failed batch are moved to dead-letter queue,
+// including items which would be processed successfully alone
+func (sc *StreamConfig) DeadLetter(maxAttempts int, queue *mapqueue.Queue) *StreamConfig {
+	sc.maxAttempts = maxAttempts
+	sc.deadLetters = queue
+	return sc
+}
+
+// Process up to N messages in parallel. Each worker handles exactly one message at a time (batch mode is not
+// applied). Commit mode defines how completed messages are removed from queue. Messages are dispatched ahead of the
+// oldest not committed message by no more than 16 messages per worker. By default only one worker is used
+func (sc *StreamConfig) Workers(n int, commit CommitMode) *StreamConfig {
+	sc.workers = n
+	sc.commit = commit
+	return sc
+}
+
 // Initialize and start stream. Builder should be no modified after calling this method
 func (sc *StreamConfig) Start() *Stream {
 	child, stop := context.WithCancel(sc.ctx)
@@ -83,9 +171,10 @@ func (sc *StreamConfig) Start() *Stream {
 
 // Processing stream
 type Stream struct {
-	cfg  StreamConfig
-	stop func()
-	done chan error
+	cfg   StreamConfig
+	stop  func()
+	done  chan error
+	stats streamStats
 }
 
 // Done channel. Once finished, channel will be closed
@@ -103,16 +192,21 @@ func (s *Stream) start(ctx context.Context) {
 	// run once!
 	go func() {
 		defer close(s.done)
-		s.done <- s.run(ctx)
+		err := s.run(ctx)
+		s.stats.stop()
+		s.done <- err
 	}()
 }
 
 func (s *Stream) run(ctx context.Context) error {
-	sub := s.cfg.queue.OnCreated().Subscribe()
+	if s.cfg.workers > 1 && s.cfg.priority == nil {
+		return s.runWorkers(ctx)
+	}
+	sub := s.subscribe()
 	defer sub.Close()
 LOOP:
 	for {
-		processed, err := s.processNotification(ctx)
+		processed, err := s.processNotification(ctx, sub)
 		if err != nil {
 			return err
 		}
@@ -128,54 +222,149 @@ LOOP:
 	return nil
 }
 
-func (s *Stream) processNotification(ctx context.Context) (bool, error) {
+func (s *Stream) processNotification(ctx context.Context, sub *mapqueue.Subscription) (bool, error) {
+	if len(s.cfg.handlers) == 0 {
+		return false, nil
+	}
+	if s.empty() {
+		return false, nil
+	}
+	s.linger(ctx, sub)
+	queue := s.next()
+	if queue == nil {
+		return false, nil
+	}
+	envelopes, err := s.head(queue)
+	if err == mapqueue.ErrEmpty {
+		// only missing items were left and skipped
+		return false, nil
+	} else if err != nil {
+		s.cfg.logger.Println("failed get head from queue:", err)
+		return false, err
+	}
+	err = s.process(ctx, envelopes)
+	if err != nil {
+		return false, err
+	}
+	// items could be dropped by queue retention while processing, so commit by ids instead of position
+	var ids = make([]int64, len(envelopes))
+	for i, env := range envelopes {
+		ids[i] = env.Id
+	}
+	err = queue.CommitBatch(ids)
+	if err != nil {
+		s.cfg.logger.Println("failed commit:", err)
+		return false, err
+	}
+	return true, nil
+}
+
+// process items till success or exceeding of attempts. Returns nil if items should be committed
+func (s *Stream) process(ctx context.Context, envelopes []*mapqueue.Envelope) error {
+	var items = make([][]byte, len(envelopes))
+	for i, env := range envelopes {
+		items[i] = env.Data
+	}
+	ctx = context.WithValue(ctx, envelopesKey{}, envelopes)
+	ctx = strategy.WithMessage(ctx)
+	s.stats.begin()
+	defer s.stats.end()
 	var handlerErr error
+	var attempts int
 	for {
 		select {
 		case <-ctx.Done():
-			return false, ctx.Err()
+			return ctx.Err()
 		default:
 
 		}
-		if len(s.cfg.handlers) == 0 {
-			return false, nil
-		}
-		if s.cfg.queue.Empty() {
-			return false, nil
-		}
-		data, err := s.cfg.queue.Head()
-		if err != nil {
-			s.cfg.logger.Println("failed get head from queue:", err)
-			return false, err
+		if attempts > 0 {
+			s.stats.retry()
 		}
 
+		attemptCtx := strategy.WithAttempt(ctx, attempts+1)
 		for i, h := range s.cfg.handlers {
-			handlerErr = h(ctx, data)
+			handlerErr = h(attemptCtx, items)
 			select {
 			case <-ctx.Done():
-				return false, ctx.Err()
+				return ctx.Err()
 			default:
 
 			}
 			if handlerErr != nil {
-				s.cfg.logger.Println("handler", i, ":", handlerErr, "(queue size", s.cfg.queue.Size(), ")")
+				s.cfg.logger.Println("handler", i, ":", handlerErr, "(queue size", s.size(), ")")
 				break
 			}
 		}
+		if handlerErr == nil {
+			s.stats.success(len(items))
+		} else {
+			s.stats.failure(handlerErr)
+			attempts++
+			if s.cfg.maxAttempts > 0 && attempts >= s.cfg.maxAttempts {
+				s.stats.giveUp(len(items))
+				err := s.deadLetter(items, attempts, handlerErr)
+				if err != nil {
+					s.cfg.logger.Println("failed move to dead-letter queue:", err)
+				}
+				return err
+			}
+		}
 		if s.cfg.strategy != nil {
-			handlerErr = s.cfg.strategy.Done(ctx, handlerErr)
+			handlerErr = s.finish(attemptCtx, handlerErr)
 		}
-		if handlerErr != nil {
-			continue
+		if handlerErr == nil {
+			return nil
 		}
-		err = s.cfg.queue.Remove()
-		if err != nil {
-			s.cfg.logger.Println("failed commit:", err)
-			return false, err
+	}
+}
+
+// apply finish strategy to result of attempt. Stream is backing off while strategy handles failure
+func (s *Stream) finish(ctx context.Context, handlerErr error) error {
+	if handlerErr == nil {
+		return s.cfg.strategy.Done(ctx, nil)
+	}
+	s.stats.backOff()
+	defer s.stats.resume()
+	return s.cfg.strategy.Done(ctx, handlerErr)
+}
+
+// wait till queue has enough items for full batch or linger time elapsed
+func (s *Stream) linger(ctx context.Context, sub *mapqueue.Subscription) {
+	if s.cfg.batch.linger <= 0 || s.cfg.batch.maxItems <= 1 {
+		return
+	}
+	timer := time.NewTimer(s.cfg.batch.linger)
+	defer timer.Stop()
+	for s.size() < int64(s.cfg.batch.maxItems) {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+			return
+		case <-sub.Wait():
+
 		}
-		break
 	}
-	return true, nil
+}
+
+// get items for batch from head of queue according to limits
+func (s *Stream) head(queue *mapqueue.Queue) ([]*mapqueue.Envelope, error) {
+	items, err := queue.HeadEnvelopes(s.cfg.batch.maxItems)
+	if err != nil {
+		return nil, err
+	}
+	if s.cfg.batch.maxBytes <= 0 {
+		return items, nil
+	}
+	var size int
+	for i, env := range items {
+		size += len(env.Data)
+		if size > s.cfg.batch.maxBytes && i > 0 {
+			return items[:i], nil
+		}
+	}
+	return items, nil
 }
 
 // General logger interface
@@ -183,3 +372,33 @@ type Logger interface {
 	// Print items in line
 	Println(...interface{})
 }
+
+// subscribe for new items in source queue
+func (s *Stream) subscribe() *mapqueue.Subscription {
+	if s.cfg.priority != nil {
+		return s.cfg.priority.Subscribe()
+	}
+	return s.cfg.queue.OnCreated().Subscribe()
+}
+
+// queue to read next batch from or nil if there are no items
+func (s *Stream) next() *mapqueue.Queue {
+	if s.cfg.priority != nil {
+		return s.cfg.priority.Next()
+	}
+	return s.cfg.queue
+}
+
+func (s *Stream) empty() bool {
+	if s.cfg.priority != nil {
+		return s.cfg.priority.Empty()
+	}
+	return s.cfg.queue.Empty()
+}
+
+func (s *Stream) size() int64 {
+	if s.cfg.priority != nil {
+		return s.cfg.priority.Size()
+	}
+	return s.cfg.queue.Size()
+}
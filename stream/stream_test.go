@@ -0,0 +1,270 @@
+package stream
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"github.com/reddec/wal/mapqueue"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStream_retentionWhileProcessing(t *testing.T) {
+	queue, err := mapqueue.New(memstorage.New()).Limit(2, 0, 0).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	delivered := make(chan string, 3)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	stream := New(queue).Context(ctx).Process(func(ctx context.Context, data []byte) error {
+		if string(data) == "x" {
+			close(started)
+			<-release
+		}
+		delivered <- string(data)
+		return nil
+	}).Start()
+
+	if err := queue.PutString("x"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// x is dropped by retention while it is processing
+	if err := queue.PutString("y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("z"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	for _, expected := range []string{"x", "y", "z"} {
+		select {
+		case item := <-delivered:
+			if item != expected {
+				t.Fatalf("expected %v, got %v", expected, item)
+			}
+		case err := <-stream.Done():
+			t.Fatal("stream stopped:", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", expected)
+		}
+	}
+}
+
+// start stream in batch mode and collect delivered batches
+func startBatches(queue *mapqueue.Queue, maxItems, maxBytes int, linger time.Duration) (*Stream, <-chan []string) {
+	batches := make(chan []string, 16)
+	stream := New(queue).Batch(maxItems, maxBytes, linger).ProcessBatch(func(ctx context.Context, items [][]byte) error {
+		var batch []string
+		for _, item := range items {
+			batch = append(batch, string(item))
+		}
+		batches <- batch
+		return nil
+	}).Start()
+	return stream, batches
+}
+
+func expectBatch(t *testing.T, stream *Stream, batches <-chan []string, expected ...string) {
+	select {
+	case batch := <-batches:
+		if !reflect.DeepEqual(batch, expected) {
+			t.Fatalf("expected batch %v, got %v", expected, batch)
+		}
+	case err := <-stream.Done():
+		t.Fatal("stream stopped:", err)
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for batch", expected)
+	}
+}
+
+func TestStream_batchMaxBytes(t *testing.T) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	items := []string{"aaaa", "bbbb", "cccc", "dddddddddddd", "ee"}
+	for _, item := range items {
+		if err := queue.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	stream, batches := startBatches(queue, 10, 8, 0)
+	defer stream.Stop()
+	expectBatch(t, stream, batches, "aaaa", "bbbb")
+	expectBatch(t, stream, batches, "cccc")
+	// item bigger than limit is delivered alone
+	expectBatch(t, stream, batches, "dddddddddddd")
+	expectBatch(t, stream, batches, "ee")
+}
+
+func TestStream_batchLinger(t *testing.T) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const linger = 100 * time.Millisecond
+	if err := queue.PutString("a"); err != nil {
+		t.Fatal(err)
+	}
+	started := time.Now()
+	stream, batches := startBatches(queue, 3, 0, linger)
+	defer stream.Stop()
+	// partial batch is delivered after linger time
+	expectBatch(t, stream, batches, "a")
+	if elapsed := time.Since(started); elapsed < linger {
+		t.Fatal("partial batch is delivered before linger time:", elapsed)
+	}
+	// full batch is delivered without waiting
+	if err := queue.PutBatch([][]byte{[]byte("b"), []byte("c"), []byte("d")}); err != nil {
+		t.Fatal(err)
+	}
+	expectBatch(t, stream, batches, "b", "c", "d")
+}
+
+func TestStream_batchHandlers(t *testing.T) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutBatch([][]byte{[]byte("a"), []byte("b")}); err != nil {
+		t.Fatal(err)
+	}
+	calls := make(chan string, 4)
+	handler := func(name string) StreamHandlerFunc {
+		return func(ctx context.Context, data []byte) error {
+			calls <- name + ":" + string(data)
+			return nil
+		}
+	}
+	stream := New(queue).Batch(2, 0, 0).Process(handler("first")).Process(handler("second")).Start()
+	defer stream.Stop()
+	// each handler processes whole batch before next handler
+	for _, expected := range []string{"first:a", "first:b", "second:a", "second:b"} {
+		select {
+		case call := <-calls:
+			if call != expected {
+				t.Fatalf("expected %v, got %v", expected, call)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", expected)
+		}
+	}
+}
+
+// start stream over queue where item b is missing and collect delivered items
+func streamWithHole(t *testing.T, items ...string) (*mapqueue.Queue, *Stream, <-chan string, func()) {
+	storage := memstorage.New()
+	queue, err := mapqueue.NewMapQueue(storage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, item := range items {
+		if err := queue.PutString(item); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// the only way to make a hole from outside of package is removing item key directly
+	err = storage.Keys(func(key []byte) error {
+		if value, err := storage.Get(key); err == nil && string(value) == "b" {
+			return storage.Del(append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	delivered := make(chan string, len(items)+1)
+	ctx, stop := context.WithCancel(context.Background())
+	stream := New(queue).Context(ctx).Process(func(ctx context.Context, data []byte) error {
+		delivered <- string(data)
+		return nil
+	}).Start()
+	return queue, stream, delivered, stop
+}
+
+func expectDelivered(t *testing.T, stream *Stream, delivered <-chan string, items ...string) {
+	for _, expected := range items {
+		select {
+		case item := <-delivered:
+			if item != expected {
+				t.Fatalf("expected %v, got %v", expected, item)
+			}
+		case err := <-stream.Done():
+			t.Fatal("stream stopped:", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", expected)
+		}
+	}
+}
+
+func TestStream_holeInTheMiddle(t *testing.T) {
+	queue, stream, delivered, stop := streamWithHole(t, "a", "b", "c")
+	defer stop()
+	expectDelivered(t, stream, delivered, "a", "c")
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("item after missing one is not committed, size", queue.Size())
+		}
+	}
+}
+
+func TestStream_holeAtTheTail(t *testing.T) {
+	queue, stream, delivered, stop := streamWithHole(t, "b")
+	defer stop()
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("missing item is not skipped")
+		}
+	}
+	if err := queue.PutString("c"); err != nil {
+		t.Fatal(err)
+	}
+	expectDelivered(t, stream, delivered, "c")
+}
+
+func TestStream_priorityLanes(t *testing.T) {
+	queue, err := mapqueue.New(memstorage.New()).Weights(2, 1).OpenPriority(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 1; i <= 4; i++ {
+		if err := queue.Put(1, []byte("l"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+		if err := queue.Put(0, []byte("h"+strconv.Itoa(i))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	delivered := make(chan string, 8)
+	stream := NewPriority(queue).Process(func(ctx context.Context, data []byte) error {
+		delivered <- string(data)
+		return nil
+	}).Start()
+	defer stream.Stop()
+
+	// two items of level 0 per one item of level 1 while both lanes have items
+	for _, expected := range []string{"h1", "l1", "h2", "h3", "l2", "h4", "l3", "l4"} {
+		select {
+		case item := <-delivered:
+			if item != expected {
+				t.Fatal("expected", expected, "got", item)
+			}
+		case err := <-stream.Done():
+			t.Fatal("stream stopped:", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout waiting for", expected)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("lanes are not drained, size", queue.Size())
+		}
+	}
+}
@@ -0,0 +1,122 @@
+package stream
+
+import (
+	"context"
+	"github.com/reddec/wal/mapqueue"
+)
+
+// Mode of commit for parallel processing
+type CommitMode int
+
+const (
+	// Read pointer of queue moves only over contiguous prefix of completed messages. Completed messages after
+	// not completed one are kept in storage and will be processed again after restart
+	OrderedCommit CommitMode = 0
+	// Each completed message is removed from queue immediately regardless of previous messages
+	UnorderedCommit CommitMode = 1
+)
+
+// how many messages per worker could be dispatched ahead of the oldest not committed message
+const readAhead = 16
+
+type workerResult struct {
+	id  int64
+	err error
+}
+
+func (s *Stream) runWorkers(ctx context.Context) error {
+	if len(s.cfg.handlers) == 0 {
+		<-ctx.Done()
+		return nil
+	}
+	sub := s.cfg.queue.OnCreated().Subscribe()
+	defer sub.Close()
+
+	results := make(chan workerResult, s.cfg.workers)
+	completed := make(map[int64]bool) // for ordered commit
+	next := s.cfg.queue.ReadId()
+	active := 0
+	var resultErr error
+
+	for resultErr == nil {
+		// dispatch as much as possible
+		for active < s.cfg.workers {
+			head := s.cfg.queue.ReadId()
+			if next < head {
+				next = head
+			}
+			if next >= s.cfg.queue.WriteId() || next-head >= int64(s.cfg.workers*readAhead) {
+				break
+			}
+			env, err := s.cfg.queue.GetEnvelope(next)
+			if err == mapqueue.ErrNotFound {
+				// removed out of order before restart
+				if err = s.cfg.queue.Commit(next); err != nil {
+					resultErr = err
+					break
+				}
+				next++
+				continue
+			} else if err != nil {
+				s.cfg.logger.Println("failed get item", next, "from queue:", err)
+				resultErr = err
+				break
+			}
+			active++
+			go func(id int64, env *mapqueue.Envelope) {
+				results <- workerResult{id: id, err: s.process(ctx, []*mapqueue.Envelope{env})}
+			}(next, env)
+			next++
+		}
+		if resultErr != nil {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			resultErr = ctx.Err()
+		case res := <-results:
+			active--
+			if res.err != nil {
+				resultErr = res.err
+			} else if err := s.commit(res.id, completed); err != nil {
+				s.cfg.logger.Println("failed commit:", err)
+				resultErr = err
+			}
+		case <-sub.Wait():
+
+		}
+	}
+	// wait for active workers. Completed messages are still committed
+	for ; active > 0; active-- {
+		res := <-results
+		if res.err == nil {
+			if err := s.commit(res.id, completed); err != nil {
+				s.cfg.logger.Println("failed commit:", err)
+			}
+		}
+	}
+	if resultErr == ctx.Err() {
+		return nil
+	}
+	return resultErr
+}
+
+func (s *Stream) commit(id int64, completed map[int64]bool) error {
+	if s.cfg.commit == UnorderedCommit {
+		return s.cfg.queue.Commit(id)
+	}
+	completed[id] = true
+	// read pointer could be moved by retention, so commit by ids instead of position
+	head := s.cfg.queue.ReadId()
+	for done := range completed {
+		if done < head {
+			delete(completed, done)
+		}
+	}
+	var ids []int64
+	for ; completed[head]; head++ {
+		ids = append(ids, head)
+		delete(completed, head)
+	}
+	return s.cfg.queue.CommitBatch(ids)
+}
@@ -0,0 +1,199 @@
+package stream
+
+import (
+	"context"
+	"github.com/reddec/storages/memstorage"
+	"github.com/reddec/wal/mapqueue"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestStream_workersWithoutHandlers(t *testing.T) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream := New(queue).Workers(2, OrderedCommit).Start()
+	select {
+	case err := <-stream.Done():
+		t.Fatal("stream without handlers stopped:", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+	stream.Stop()
+}
+
+func TestStream_workersHeadRemovedWhileProcessing(t *testing.T) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	delivered := make(chan string, 3)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	stream := New(queue).Context(ctx).Workers(2, OrderedCommit).Process(func(ctx context.Context, data []byte) error {
+		if string(data) == "x" {
+			close(started)
+			<-release
+		}
+		delivered <- string(data)
+		return nil
+	}).Start()
+
+	if err := queue.PutString("x"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// x is removed by other reader while it is processing
+	if err := queue.Remove(); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("z"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	var got = make(map[string]bool)
+	for len(got) < 3 {
+		select {
+		case item := <-delivered:
+			got[item] = true
+		case err := <-stream.Done():
+			t.Fatal("stream stopped:", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout, delivered", got)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("processed items are not committed, size", queue.Size())
+		}
+	}
+	// nothing is removed without processing
+	if err := queue.PutString("w"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case item := <-delivered:
+		if item != "w" {
+			t.Fatal("expected w, got", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for w")
+	}
+}
+
+func TestStream_workersRetentionWhileProcessing(t *testing.T) {
+	queue, err := mapqueue.New(memstorage.New()).Limit(2, 0, 0).Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan struct{})
+	release := make(chan struct{})
+	delivered := make(chan string, 3)
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	stream := New(queue).Context(ctx).Workers(2, OrderedCommit).Process(func(ctx context.Context, data []byte) error {
+		if string(data) == "x" {
+			close(started)
+			<-release
+		}
+		delivered <- string(data)
+		return nil
+	}).Start()
+
+	if err := queue.PutString("x"); err != nil {
+		t.Fatal(err)
+	}
+	<-started
+	// x is dropped by retention while it is processing
+	if err := queue.PutString("y"); err != nil {
+		t.Fatal(err)
+	}
+	if err := queue.PutString("z"); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+
+	var got = make(map[string]bool)
+	for len(got) < 3 {
+		select {
+		case item := <-delivered:
+			got[item] = true
+		case err := <-stream.Done():
+			t.Fatal("stream stopped:", err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("timeout, delivered", got)
+		}
+	}
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("processed items are not committed, size", queue.Size())
+		}
+	}
+	// nothing is removed without processing
+	if err := queue.PutString("w"); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case item := <-delivered:
+		if item != "w" {
+			t.Fatal("expected w, got", item)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timeout waiting for w")
+	}
+}
+
+func TestStream_workersReadAhead(t *testing.T) {
+	queue, err := mapqueue.NewMapQueue(memstorage.New())
+	if err != nil {
+		t.Fatal(err)
+	}
+	const workers, total = 2, 100
+	release := make(chan struct{})
+	var processed int64
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	stream := New(queue).Context(ctx).Workers(workers, OrderedCommit).Process(func(ctx context.Context, data []byte) error {
+		if string(data) == "0" {
+			<-release
+		}
+		atomic.AddInt64(&processed, 1)
+		return nil
+	}).Start()
+
+	for i := 0; i < total; i++ {
+		if err := queue.PutString(strconv.Itoa(i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(200 * time.Millisecond)
+	// first item is not committed, so dispatcher stops after read-ahead window
+	if n := atomic.LoadInt64(&processed); n >= workers*readAhead {
+		t.Fatal("dispatched too far ahead of not committed item:", n+1)
+	}
+	close(release)
+	for deadline := time.Now().Add(5 * time.Second); !queue.Empty(); time.Sleep(10 * time.Millisecond) {
+		select {
+		case err := <-stream.Done():
+			t.Fatal("stream stopped:", err)
+		default:
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("queue is not drained, size", queue.Size())
+		}
+	}
+	if n := atomic.LoadInt64(&processed); n != total {
+		t.Fatal("expected", total, "processed items, got", n)
+	}
+}